@@ -0,0 +1,130 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/WofWca/snowflake-generalized/common"
+)
+
+// Establishes a connection to the server, which is a bond
+// of `Config.Paths` Snowflake connections if bonding
+// or `Config.Resumable` is enabled.
+// `retry` is whether to retry according to `Config.Retry`.
+func (c *Client) connect(ctx context.Context, retry bool, ownTransport bool) (*dialedConn, error) {
+	if c.config.Paths > 1 || c.config.Resumable {
+		return c.connectBonded(ctx, retry)
+	}
+	opts := dialOptions{ownTransport: ownTransport}
+	if retry {
+		return c.dialSnowflakeWithRetry(ctx, opts)
+	}
+	return c.dialSnowflake(opts)
+}
+
+func (c *Client) connectBonded(ctx context.Context, retry bool) (*dialedConn, error) {
+	bondHello := &common.BondHello{ID: common.NewBondID()}
+	hello := *c.hello
+	hello.Bond = bondHello
+	// The paths exist simultaneously, so they can't share a transport.
+	opts := dialOptions{ownTransport: true, hello: &hello}
+	var first *dialedConn
+	var err error
+	if retry {
+		first, err = c.dialSnowflakeWithRetry(ctx, opts)
+	} else {
+		first, err = c.dialSnowflake(opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !first.result.HasFeature(common.FeatureBonding) {
+		log.Print(
+			"The server does not support bonding," +
+				" the connection will not survive losing the proxy",
+		)
+		return first, nil
+	}
+
+	bond := common.NewBond(bondHello.ID)
+	pathDone, err := bond.AddPath(first.Conn)
+	if err != nil {
+		first.Close()
+		return nil, err
+	}
+	// All the paths must go to the same server,
+	// so the endpoint is not rotated for them.
+	go c.keepBondPath(bond, first.endpoint, pathDone)
+	for range max(c.config.Paths, 1) - 1 {
+		go c.keepBondPath(bond, first.endpoint, nil)
+	}
+	return &dialedConn{Conn: bond, result: first.result, endpoint: first.endpoint}, nil
+}
+
+var errBondingNotNegotiated = errors.New("the server did not accept the path")
+
+// Keeps one path of the bond: waits until it's lost
+// (if `pathDone` is not `nil`) and adds a new one, until the bond is closed.
+func (c *Client) keepBondPath(bond *common.Bond, endpoint Endpoint, pathDone <-chan struct{}) {
+	hello := *c.hello
+	hello.Bond = &common.BondHello{ID: bond.ID(), Join: true}
+
+	for attempt := 1; ; attempt++ {
+		if pathDone != nil {
+			select {
+			case <-pathDone:
+			case <-bond.Done():
+				return
+			}
+			log.Printf("Lost a path of the bond, %v left. Adding a new one", bond.PathCount())
+			pathDone = nil
+			attempt = 1
+		}
+		select {
+		case <-bond.Done():
+			return
+		case <-c.closed:
+			return
+		default:
+		}
+
+		transport, err := c.endpoints.newTransport(endpoint)
+		if err == nil {
+			conn, result, dialErr := c.dialEndpoint(endpoint, transport, &hello)
+			err = dialErr
+			if err == nil && !result.HasFeature(common.FeatureBonding) {
+				conn.Close()
+				err = errBondingNotNegotiated
+			}
+			if err == nil {
+				pathDone, err = bond.AddPath(conn)
+				if err != nil {
+					// The bond is closed.
+					conn.Close()
+					return
+				}
+				continue
+			}
+		}
+
+		delay := c.config.Retry.delay(attempt)
+		log.Printf(
+			"Failed to add a path to the bond (attempt %v): %v. Retrying in %v",
+			attempt,
+			err,
+			delay.Round(time.Millisecond),
+		)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-bond.Done():
+			timer.Stop()
+			return
+		case <-c.closed:
+			timer.Stop()
+			return
+		}
+	}
+}
@@ -0,0 +1,582 @@
+/*
+Package client implements the Snowflake Generalized client,
+i.e. the part that accepts application connections
+and forwards them to the server through Snowflake.
+
+	c, err := client.NewClient(client.Config{
+		Snowflake: snowflakeClient.ClientConfig{
+			BrokerURL: "https://broker.example.com/",
+			RelayURL:  "wss://server.example.com:7901",
+			// ...
+		},
+		DestinationProtocol: "tcp",
+	})
+	if err != nil {
+		// handle error
+	}
+	defer c.Close()
+	if err := c.Start(ctx); err != nil {
+		// handle error
+	}
+	// Either forward connections from a listener...
+	err = c.Forward(listener)
+	// ... or make connections to the destination yourself.
+	conn, err := c.Dial()
+*/
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/WofWca/snowflake-generalized/common"
+	"github.com/xtaci/smux"
+	snowflakeClient "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/client/lib"
+)
+
+// Config defines how the client connects to the server
+// and what it forwards.
+type Config struct {
+	// Snowflake is passed to `snowflakeClient.NewSnowflakeClient`.
+	// Specify either `RelayURL` or `BridgeFingerprint` to select the server,
+	// unless `Endpoints` is set.
+	Snowflake snowflakeClient.ClientConfig
+
+	// Endpoints are the servers and brokers to use, in order of preference.
+	// If a connection can't be established through an endpoint,
+	// or its sessions keep dying, the next one is used.
+	// If empty, the server and the broker from `Snowflake` are used.
+	Endpoints []Endpoint
+	// ShuffleEndpoints randomizes the order of `Endpoints`.
+	ShuffleEndpoints bool
+	// SessionFailuresBeforeRotation is how many times in a row
+	// a session may die shortly after it has been established
+	// before switching to the next endpoint. Only for mux mode.
+	// Defaults to 3.
+	SessionFailuresBeforeRotation int
+	// StateFile is where to remember the endpoint that worked last,
+	// so that it's tried first the next time. Optional.
+	StateFile string
+
+	// DestinationProtocol is what type of packets to forward,
+	// i.e. what protocol the target application
+	// (WireGuard, SOCKS server) is using, "udp" or "tcp".
+	// This value must be the same on the server.
+	DestinationProtocol string
+
+	// SingleConnMode turns off multiplexing:
+	// each connection gets its own Snowflake connection.
+	// The value must be the same for both the server and the client.
+	SingleConnMode bool
+
+	// MaxConnections limits how many connections `Forward()` forwards
+	// at the same time, and how many peers `ForwardUDP()` keeps track of.
+	// 0 means no limit.
+	// Keep in mind that in single-connection mode every connection
+	// occupies a Snowflake proxy.
+	MaxConnections int
+	// UDPIdleTimeout is how long `ForwardUDP()` keeps forwarding
+	// for a local peer that hasn't sent or received anything.
+	// 0 means 3 minutes.
+	UDPIdleTimeout time.Duration
+
+	// Retry defines how connecting to the server is retried,
+	// both initially and after the connection has been lost.
+	Retry RetryPolicy
+	// FailFast makes `Dial()` return `ErrNotConnected` right away
+	// when there is no connection to the server at the moment,
+	// instead of waiting until it has been (re-)established.
+	// The connection is then established in the background.
+	// In single-connection mode `Dial()` goes through the endpoints once
+	// instead of retrying.
+	FailFast bool
+
+	// Sessions is how many Snowflake connections to use simultaneously
+	// in mux mode, each through a different proxy, so that
+	// the throughput is not limited by a single proxy.
+	// New connections are distributed between them
+	// according to `StripingStrategy`. Defaults to 1.
+	Sessions int
+	// StripingStrategy defaults to `LeastStreams`.
+	StripingStrategy StripingStrategy
+
+	// Paths, if greater than 1, makes every connection to the server
+	// a bond of this many Snowflake connections through different proxies.
+	// Data is split between them and reassembled on the other side,
+	// so even a single big transfer is not limited by one proxy's bandwidth.
+	// If one of them is lost, it is replaced, and the data is resent
+	// on the remaining ones.
+	// Requires a server that supports it.
+	Paths int
+	// Resumable makes connections to the server survive losing
+	// the Snowflake proxy: the client reconnects through a new proxy
+	// and the server reattaches it to the same destination connection,
+	// resending the data that might have been lost.
+	// The server waits for that for `common.BondPathTimeout`,
+	// and only lets the same client (with the same `Config.Token`) resume.
+	// This is mostly useful in single-connection mode,
+	// for long-lived flows such as WireGuard.
+	// It's implied by `Paths` > 1. Requires a server that supports it.
+	Resumable bool
+
+	// IdleTimeout, if not 0, closes the Snowflake connection
+	// when there have been no connections for this long,
+	// so that we don't occupy a volunteer's proxy needlessly.
+	// It is re-established on the next `Dial()`.
+	// Only for mux mode. To also connect only when the first
+	// connection arrives, just don't call `Start()`.
+	IdleTimeout time.Duration
+
+	// StandbyConnections is how many connections to the server
+	// to keep established in advance, because getting a Snowflake proxy
+	// may take from seconds to minutes.
+	// In mux mode a standby connection replaces the session
+	// when it dies, in single-connection mode it is used
+	// for a new connection.
+	// Keep in mind that each of them occupies a Snowflake proxy,
+	// and, in single-connection mode, a connection to the destination.
+	// The standby connections are kept even with `IdleTimeout`.
+	StandbyConnections int
+
+	// SocketMark, if not 0, sets `SO_MARK` on the sockets of the connections
+	// to the broker, STUN servers and Snowflake proxies,
+	// so that they can bypass a full-tunnel VPN
+	// (e.g. the client's own `ServeTUN()`) with policy routing, e.g.
+	// `ip rule add fwmark 0x5f lookup main priority 100`.
+	// Requires `CAP_NET_ADMIN`. Linux only.
+	//
+	// This and `BindInterface` make the Snowflake library
+	// use `Snowflake.CommunicationProxy`, so that must not be set.
+	SocketMark uint32
+	// BindInterface, if set, binds the sockets of the connections
+	// to the broker, STUN servers and Snowflake proxies
+	// to this network interface (`SO_BINDTODEVICE`), see `SocketMark`.
+	// Linux only.
+	BindInterface string
+
+	// ClientDestinations makes the client choose the destination
+	// of every connection, see `DialDestination()`.
+	// `Dial()` can't be used then.
+	// Only in mux mode. Requires a server that allows it.
+	ClientDestinations bool
+
+	// DNS makes the client offer `common.FeatureDNS`,
+	// which `ServeDNS()` and `ServeDNSTCP()` need.
+	// Only in mux mode. Requires a server with a resolver configured.
+	DNS bool
+
+	// Reverse makes the client offer `common.FeatureReverse`,
+	// which `ServeReverse()` needs.
+	// Only in mux mode, and not with `IdleTimeout`.
+	// Requires a server with a reverse listener.
+	Reverse bool
+
+	// Token identifies the client to the server as one of its users,
+	// see `common.Hello.Token`.
+	Token string
+
+	// ServerIsOldVersion skips the handshake and assumes
+	// that the server uses smux version 1.
+	// In single-connection mode this avoids waiting
+	// for `common.HandshakeTimeout` to find out that the server
+	// doesn't perform the handshake, see `common.ClientHandshake`.
+	//
+	// Deprecated: the smux version is negotiated with the server,
+	// or detected automatically for servers that don't support
+	// the negotiation.
+	ServerIsOldVersion bool
+}
+
+// ErrClosed is returned when the client has been closed.
+var ErrClosed = errors.New("client is closed")
+
+// ErrNotConnected is returned by `Dial()` in `FailFast` mode
+// when there is no connection to the server.
+var ErrNotConnected = errors.New("not connected to the server")
+
+// Client forwards connections to the server through Snowflake.
+type Client struct {
+	config    Config
+	endpoints *endpointRotator
+	hello     *common.Hello
+	// `Transport.Dial()`, which tests replace with a direct connection
+	// to the server.
+	dialTransport func(*snowflakeClient.Transport) (net.Conn, error)
+
+	// Only in mux mode, `Config.Sessions` of them.
+	sessions []*muxSessionSlot
+
+	// Protects the fields below, and the fields of `sessions`.
+	mu sync.Mutex
+	// By `Endpoint.serverKey()`.
+	legacyServers map[string]legacyServerInfo
+	// The streams opened by `Dial()` that haven't been closed yet,
+	// in all the sessions.
+	activeStreams int
+	// Closes the mux sessions after `Config.IdleTimeout`.
+	idleTimer *time.Timer
+	// The sessions replaced by `Reconnect()` that still have streams.
+	drainingSessions int
+	// See `AddForward()`. By `PortForward.ListenAddress`.
+	forwards map[string]*portForward
+
+	// See `Config.SocketMark`. `nil` if not used.
+	outbound *outboundProxy
+
+	// See `ServeDNS()`.
+	dnsCache *dnsCache
+
+	startStandbyOnce sync.Once
+	standby          chan *dialedConn
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewClient creates a client. Call `Start()` before using it.
+func NewClient(config Config) (*Client, error) {
+	if config.DestinationProtocol != "tcp" && config.DestinationProtocol != "udp" {
+		return nil, errors.New("DestinationProtocol must either be \"tcp\" or \"udp\"")
+	}
+
+	if config.ClientDestinations && config.SingleConnMode {
+		return nil, errors.New("ClientDestinations is only supported in mux mode")
+	}
+	if config.DNS && config.SingleConnMode {
+		return nil, errors.New("DNS is only supported in mux mode")
+	}
+	if config.Reverse && config.SingleConnMode {
+		return nil, errors.New("Reverse is only supported in mux mode")
+	}
+	if config.Reverse && config.IdleTimeout > 0 {
+		// The server can only reach the client while it's connected.
+		return nil, errors.New("Reverse can't be used with IdleTimeout")
+	}
+
+	config.Retry = config.Retry.withDefaults()
+	if config.Sessions == 0 {
+		config.Sessions = 1
+	}
+	if config.StripingStrategy == "" {
+		config.StripingStrategy = LeastStreams
+	}
+	if !slices.Contains(StripingStrategies, config.StripingStrategy) {
+		return nil, fmt.Errorf(
+			"unknown striping strategy %q, must be one of %v",
+			config.StripingStrategy,
+			StripingStrategies,
+		)
+	}
+
+	var outbound *outboundProxy
+	if config.SocketMark != 0 || config.BindInterface != "" {
+		if config.Snowflake.CommunicationProxy != nil {
+			return nil, errors.New(
+				"SocketMark and BindInterface can't be used with CommunicationProxy",
+			)
+		}
+		var err error
+		outbound, err = newOutboundProxy(config.SocketMark, config.BindInterface)
+		if err != nil {
+			return nil, err
+		}
+		config.Snowflake.CommunicationProxy = outbound.url()
+	}
+
+	endpoints, err := newEndpointRotator(config)
+	if err != nil {
+		if outbound != nil {
+			outbound.Close()
+		}
+		return nil, err
+	}
+
+	hello := common.NewHello()
+	hello.ClientID = common.NewClientID()
+	hello.Token = config.Token
+	if config.DestinationProtocol != "udp" {
+		hello.RemoveFeature(common.FeatureDatagramFraming)
+	}
+	if !config.ClientDestinations {
+		hello.RemoveFeature(common.FeatureDestinations)
+	}
+	if !config.DNS {
+		hello.RemoveFeature(common.FeatureDNS)
+	}
+	if !config.Reverse {
+		hello.RemoveFeature(common.FeatureReverse)
+	}
+	c := &Client{
+		config:        config,
+		endpoints:     endpoints,
+		hello:         hello,
+		dialTransport: (*snowflakeClient.Transport).Dial,
+		legacyServers: make(map[string]legacyServerInfo),
+		forwards:      make(map[string]*portForward),
+		outbound:      outbound,
+		dnsCache:      newDNSCache(),
+		standby:       make(chan *dialedConn),
+		closed:        make(chan struct{}),
+	}
+	if !config.SingleConnMode {
+		for i := range config.Sessions {
+			c.sessions = append(c.sessions, &muxSessionSlot{index: i})
+		}
+	}
+	if config.ServerIsOldVersion {
+		for _, endpoint := range endpoints.endpoints {
+			c.legacyServers[endpoint.serverKey()] = legacyServerInfo{
+				isLegacy:    true,
+				smuxVersion: 1,
+			}
+		}
+	}
+	return c, nil
+}
+
+// Start establishes the Snowflake connections to the server,
+// retrying according to `Config.Retry`,
+// and starts establishing the `Config.StandbyConnections`.
+// It returns as soon as one of the `Config.Sessions` is established,
+// the rest are established in the background.
+// Calling it is optional: without it the connections are established
+// when they are first needed.
+// In single-connection mode it does nothing, because every `Dial()`
+// establishes its own Snowflake connection.
+func (c *Client) Start(ctx context.Context) error {
+	c.startStandby()
+	if c.config.SingleConnMode {
+		return nil
+	}
+
+	errs := make(chan error, len(c.sessions))
+	for _, slot := range c.sessions {
+		go func() {
+			slot.establishMu.Lock()
+			defer slot.establishMu.Unlock()
+			errs <- c.establishSessionLocked(ctx, slot)
+		}()
+	}
+	var firstErr error
+	for range c.sessions {
+		err := <-errs
+		if err == nil {
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Why use a multiplexer instead of `snowflakeClientTransport.Dial()`-ing
+// per each TCP connection?
+// Firstly, connecting to a new proxy takes some seconds
+// (sometimes minutes!).
+// This is not great if we expect to receive connections frequently.
+// E.g. for the case of SOCKS proxy. A browser SOCKS client
+// makes a new TCP connection per nearly every HTTP request,
+// so each request would be delayed by the amount of time
+// it takes to get a new Snowflake proxy.
+//
+// Secondly, apparently the previous `Dial()` gets discarded
+// and connection lost.
+//
+// https://github.com/xtaci/smux?tab=readme-ov-file#usage
+//
+// TODO perf: Snowflake already uses smux internally.
+// Can we maybe modify the library so that it exposes the session
+// so we can use it?
+// https://gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/-/blob/bf116939935b0a2ae2adf4f5976c349aae96e48b/client/lib/snowflake.go#L211-212
+func newMuxSession(
+	snowflakeClientConn net.Conn,
+	handshakeResult *common.HandshakeResult,
+) (*smux.Session, error) {
+	smuxConfig := smux.DefaultConfig()
+	// Version 2 seems to ~double TCP connection speed, as of 2025-01-13.
+	// Or so did it look based on a single test.
+	// It is preferred during the negotiation.
+	smuxConfig.Version = handshakeResult.SmuxVersion
+	// Connecting with Snowflake might take some minutes sometimes.
+	// Let's not close the connection on our own, and let Snowflake handle that.
+	// If the session does die, `getMuxSession()` re-establishes it.
+	smuxConfig.KeepAliveDisabled = true
+	// This seems to increase download speed by about x2,
+	// at least for the SOCKS example, based on eyeball tests.
+	// See https://gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/-/merge_requests/48
+	smuxConfig.MaxStreamBuffer = snowflakeClient.StreamSize
+
+	return smux.Client(snowflakeClientConn, smuxConfig)
+}
+
+// Dial opens a new connection to the server's destination.
+//
+// In mux mode this opens a new stream in the existing Snowflake connection.
+// If there is no connection (`Start()` hasn't been called, or failed,
+// or the connection has been lost), it is established first,
+// unless `Config.FailFast` is set.
+// In single-connection mode this establishes a new Snowflake connection.
+func (c *Client) Dial() (net.Conn, error) {
+	select {
+	case <-c.closed:
+		return nil, ErrClosed
+	default:
+	}
+
+	c.startStandby()
+
+	if c.config.SingleConnMode {
+		dialed, ok := c.takeStandby()
+		if !ok {
+			var err error
+			dialed, err = c.connect(context.Background(), !c.config.FailFast, true)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if dialed.result.HasFeature(common.FeatureDatagramFraming) {
+			return common.NewDatagramConn(dialed.Conn), nil
+		}
+		return dialed.Conn, nil
+	}
+
+	if c.config.ClientDestinations {
+		return nil, errUseDialDestination
+	}
+	stream, err := c.openStream(common.StreamTypeConnection)
+	if err != nil {
+		return nil, err
+	}
+	if stream.handshakeResult.HasFeature(common.FeatureDatagramFraming) {
+		return common.NewDatagramConn(stream), nil
+	}
+	return stream, nil
+}
+
+var errUseDialDestination = errors.New("with ClientDestinations, use DialDestination()")
+
+// ErrDestinationsNotSupported is returned by `DialDestination()`
+// if the server doesn't let clients choose the destination.
+var ErrDestinationsNotSupported = errors.New(
+	"the server doesn't let clients choose the destination",
+)
+
+// DialDestination is like `Dial()`, but the server connects to `address`
+// instead of its configured destination. `network` is "tcp" or "udp".
+// For "udp" every `Write()` and `Read()` is a single datagram.
+// Requires `Config.ClientDestinations`.
+func (c *Client) DialDestination(network string, address string) (net.Conn, error) {
+	select {
+	case <-c.closed:
+		return nil, ErrClosed
+	default:
+	}
+	if !c.config.ClientDestinations {
+		return nil, errors.New("DialDestination() requires ClientDestinations")
+	}
+	c.startStandby()
+
+	stream, err := c.openStream(common.StreamTypeConnection)
+	if err != nil {
+		return nil, err
+	}
+	if !stream.handshakeResult.HasFeature(common.FeatureDestinations) {
+		stream.Close()
+		return nil, ErrDestinationsNotSupported
+	}
+	if err := common.WriteDestinationRequest(stream, network, address); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	stream.SetReadDeadline(time.Now().Add(common.HandshakeTimeout))
+	err = common.ReadDestinationResponse(stream)
+	stream.SetReadDeadline(time.Time{})
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if network == "udp" {
+		return common.NewDatagramConn(stream), nil
+	}
+	return stream, nil
+}
+
+// ErrDNSNotSupported is returned by `ServeDNS()` and `ServeDNSTCP()`
+// for every query if the server doesn't forward DNS queries.
+var ErrDNSNotSupported = errors.New("the server doesn't forward DNS queries")
+
+// Opens a new stream in one of the mux sessions
+// and writes the stream type, if `common.FeatureDNS` is used.
+func (c *Client) openStream(streamType byte) (*trackedStream, error) {
+	stream, err := c.openAnyStream()
+	if err != nil {
+		return nil, err
+	}
+	if !stream.handshakeResult.HasFeature(common.FeatureDNS) {
+		if streamType == common.StreamTypeDNS {
+			stream.Close()
+			return nil, ErrDNSNotSupported
+		}
+		return stream, nil
+	}
+	if err := common.WriteStreamType(stream, streamType); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (c *Client) openAnyStream() (*trackedStream, error) {
+	for {
+		slot, muxSession, err := c.getMuxSession()
+		if err != nil {
+			return nil, err
+		}
+		// TODO handle errors carefully.
+		// E.g. there is `ErrGoAway` which occurs when stream IDs
+		// get exhausted, and when that happens,
+		// we can never open a new stream, which means that
+		// we probably need to recreate a smux session.
+		stream, err := c.openTrackedStream(slot, muxSession)
+		if err != nil {
+			return nil, err
+		}
+		if stream != nil {
+			return stream, nil
+		}
+		// The session has just been closed for being idle.
+	}
+}
+
+// Close closes the Snowflake connection and stops forwarding.
+func (c *Client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		close(c.closed)
+		if c.idleTimer != nil {
+			c.idleTimer.Stop()
+		}
+		for _, slot := range c.sessions {
+			if slot.session != nil {
+				err = errors.Join(err, slot.session.Close())
+			}
+		}
+		for _, forward := range c.forwards {
+			forward.listener.Close()
+		}
+		if c.outbound != nil {
+			err = errors.Join(err, c.outbound.Close())
+		}
+		log.Print("Client closed")
+	})
+	return err
+}
@@ -0,0 +1,281 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Status describes the state of the client, see `Client.Status()`.
+type Status struct {
+	// Endpoint is the one that new Snowflake connections go through.
+	Endpoint  Endpoint   `json:"endpoint"`
+	Endpoints []Endpoint `json:"endpoints"`
+	// Sessions is empty in single-connection mode.
+	Sessions []SessionStatus `json:"sessions"`
+	// DrainingSessions is how many sessions replaced by `Reconnect()`
+	// are still open because of their streams.
+	DrainingSessions int           `json:"drainingSessions"`
+	ActiveStreams    int           `json:"activeStreams"`
+	Forwards         []PortForward `json:"forwards"`
+}
+
+// SessionStatus describes one of the `Config.Sessions`.
+type SessionStatus struct {
+	Index     int  `json:"index"`
+	Connected bool `json:"connected"`
+	// Since when the session has been connected.
+	EstablishedAt *time.Time `json:"establishedAt,omitempty"`
+	ActiveStreams int        `json:"activeStreams"`
+	// Latency is the estimated latency,
+	// see `LowestLatency`. Empty if unknown.
+	Latency  string   `json:"latency,omitempty"`
+	Features []string `json:"features"`
+}
+
+// Status returns the current state of the client.
+func (c *Client) Status() Status {
+	_, endpoint := c.endpoints.current()
+	status := Status{
+		Endpoint:  endpoint,
+		Endpoints: c.endpoints.list(),
+		Sessions:  []SessionStatus{},
+		Forwards:  []PortForward{},
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status.DrainingSessions = c.drainingSessions
+	status.ActiveStreams = c.activeStreams
+	for _, slot := range c.sessions {
+		session := SessionStatus{
+			Index:         slot.index,
+			Connected:     slot.isAlive(),
+			ActiveStreams: slot.activeStreams,
+			Features:      []string{},
+		}
+		if session.Connected {
+			establishedAt := slot.establishedAt
+			session.EstablishedAt = &establishedAt
+			session.Features = slot.handshakeResult.Features
+		}
+		if slot.latency > 0 {
+			session.Latency = slot.latency.Round(time.Millisecond).String()
+		}
+		status.Sessions = append(status.Sessions, session)
+	}
+	for _, forward := range c.forwards {
+		status.Forwards = append(status.Forwards, forward.PortForward)
+	}
+	slices.SortFunc(status.Forwards, func(a, b PortForward) int {
+		return strings.Compare(a.ListenAddress, b.ListenAddress)
+	})
+	return status
+}
+
+// SwitchEndpoint makes the new Snowflake connections go through `endpoint`,
+// adding it to `Config.Endpoints` if it's not there.
+// The existing connections are not affected, see `Reconnect()`.
+// Keep in mind that the endpoint still gets rotated
+// if connecting through it fails.
+func (c *Client) SwitchEndpoint(endpoint Endpoint) error {
+	return c.endpoints.switchTo(endpoint)
+}
+
+// PortForward is a local TCP port that is forwarded to the server,
+// see `Client.AddForward()`.
+type PortForward struct {
+	ListenAddress string `json:"listenAddress"`
+	// Destination is the address that the server connects to,
+	// see `DialDestination()`. If empty, the server's own destination.
+	Destination string `json:"destination,omitempty"`
+}
+
+type portForward struct {
+	PortForward
+	listener net.Listener
+}
+
+// AddForward starts forwarding the TCP connections to `forward.ListenAddress`
+// to the server, like `Forward()`, until `RemoveForward()` is called.
+// `forward.Destination` requires `Config.ClientDestinations`,
+// and without it `Config.ClientDestinations` must not be set.
+func (c *Client) AddForward(forward PortForward) error {
+	if forward.Destination != "" && !c.config.ClientDestinations {
+		return errors.New("a forward with a destination requires ClientDestinations")
+	}
+	if forward.Destination == "" && c.config.ClientDestinations {
+		return errors.New("with ClientDestinations, a forward must have a destination")
+	}
+	c.mu.Lock()
+	_, exists := c.forwards[forward.ListenAddress]
+	c.mu.Unlock()
+	if exists {
+		return fmt.Errorf("%v is already forwarded", forward.ListenAddress)
+	}
+
+	ln, err := net.Listen("tcp", forward.ListenAddress)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	select {
+	case <-c.closed:
+		c.mu.Unlock()
+		ln.Close()
+		return ErrClosed
+	default:
+	}
+	if _, exists := c.forwards[forward.ListenAddress]; exists {
+		c.mu.Unlock()
+		ln.Close()
+		return fmt.Errorf("%v is already forwarded", forward.ListenAddress)
+	}
+	c.forwards[forward.ListenAddress] = &portForward{forward, ln}
+	c.mu.Unlock()
+
+	dial := func(net.Conn) (net.Conn, error) {
+		return c.Dial()
+	}
+	if forward.Destination != "" {
+		dial = func(net.Conn) (net.Conn, error) {
+			return c.DialDestination("tcp", forward.Destination)
+		}
+	}
+	go c.forward(ln, dial)
+	return nil
+}
+
+// ErrForwardNotFound is returned by `RemoveForward()`
+// if there is no such forward.
+var ErrForwardNotFound = errors.New("no such forward")
+
+// RemoveForward stops accepting connections for the forward
+// added by `AddForward()`. The connections that have been accepted
+// are not closed.
+func (c *Client) RemoveForward(listenAddress string) error {
+	c.mu.Lock()
+	forward, ok := c.forwards[listenAddress]
+	delete(c.forwards, listenAddress)
+	c.mu.Unlock()
+	if !ok {
+		return ErrForwardNotFound
+	}
+	return forward.listener.Close()
+}
+
+// ControlConfig configures `Client.ControlHandler()`.
+type ControlConfig struct {
+	// SetLogging, if set, is called by `PUT /logging`
+	// to turn the logs on or off.
+	SetLogging func(enabled bool)
+}
+
+// ControlHandler returns an HTTP API to manage the client at runtime:
+//
+//   - `GET /status` returns `Status()` as JSON.
+//   - `POST /reconnect` does `Reconnect()`, for the session
+//     in the "session" query parameter, or for all of them.
+//   - `PUT /endpoint` does `SwitchEndpoint()` and `Reconnect()`
+//     for all the sessions, with the `Endpoint` in the body as JSON.
+//   - `POST /forwards` does `AddForward()` with the `PortForward`
+//     in the body as JSON.
+//   - `DELETE /forwards/{listenAddress}` does `RemoveForward()`.
+//   - `PUT /logging` calls `ControlConfig.SetLogging`
+//     with the body, which is "on" or "off".
+//
+// It has no authentication, so serve it on a Unix socket
+// that only the right users can access.
+func (c *Client) ControlHandler(config ControlConfig) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Status())
+	})
+	mux.HandleFunc("POST /reconnect", func(w http.ResponseWriter, r *http.Request) {
+		index := -1
+		if session := r.URL.Query().Get("session"); session != "" {
+			var err error
+			index, err = strconv.Atoi(session)
+			if err != nil {
+				http.Error(w, "invalid session index", http.StatusBadRequest)
+				return
+			}
+		}
+		writeControlResult(w, c.Reconnect(r.Context(), index))
+	})
+	mux.HandleFunc("PUT /endpoint", func(w http.ResponseWriter, r *http.Request) {
+		var endpoint Endpoint
+		if err := json.NewDecoder(r.Body).Decode(&endpoint); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := c.SwitchEndpoint(endpoint); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if c.config.SingleConnMode {
+			// Every connection is a new Snowflake connection anyway.
+			writeControlResult(w, nil)
+			return
+		}
+		writeControlResult(w, c.Reconnect(r.Context(), -1))
+	})
+	mux.HandleFunc("POST /forwards", func(w http.ResponseWriter, r *http.Request) {
+		var forward PortForward
+		if err := json.NewDecoder(r.Body).Decode(&forward); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := c.AddForward(forward); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeControlResult(w, nil)
+	})
+	mux.HandleFunc(
+		"DELETE /forwards/{listenAddress}",
+		func(w http.ResponseWriter, r *http.Request) {
+			writeControlResult(w, c.RemoveForward(r.PathValue("listenAddress")))
+		},
+	)
+	mux.HandleFunc("PUT /logging", func(w http.ResponseWriter, r *http.Request) {
+		if config.SetLogging == nil {
+			http.Error(w, "turning the logs on and off is not supported", http.StatusNotImplemented)
+			return
+		}
+		var body strings.Builder
+		if _, err := io.Copy(&body, http.MaxBytesReader(w, r.Body, 64)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch strings.TrimSpace(body.String()) {
+		case "on":
+			config.SetLogging(true)
+		case "off":
+			config.SetLogging(false)
+		default:
+			http.Error(w, `must be "on" or "off"`, http.StatusBadRequest)
+			return
+		}
+		writeControlResult(w, nil)
+	})
+	return mux
+}
+
+func writeControlResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, ErrForwardNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,418 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/WofWca/snowflake-generalized/common"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// How many responses `dnsCache` keeps.
+	dnsCacheSize = 1024
+	// Responses are cached for their TTL, but not longer than this.
+	dnsCacheMaxTTL = time.Hour
+	// How long to wait for the server's resolver to respond.
+	dnsQueryTimeout = 10 * time.Second
+	// How many queries `ServeDNS()` and every `ServeDNSTCP()` connection
+	// may be resolving at the same time. `ServeDNS()` drops the rest
+	// (the resolvers retry), `ServeDNSTCP()` stops reading.
+	dnsMaxQueriesInFlight = 256
+	// How long `ServeDNSTCP()` keeps an idle connection open.
+	// See RFC 7766, section 6.2.3.
+	dnsTCPIdleTimeout = 30 * time.Second
+	// The response size that every DNS client supports over UDP,
+	// unless it says otherwise with EDNS(0).
+	dnsMinUDPSize = 512
+)
+
+// ServeDNS answers the DNS queries that arrive on `pconn`,
+// forwarding them through the server to its resolver
+// (see `common.FeatureDNS`), so that they don't leak locally.
+// Responses are cached for their TTL.
+// It returns when `pconn.ReadFrom()` fails or the client is closed.
+// `pconn` is not closed. Requires `Config.DNS`.
+func (c *Client) ServeDNS(pconn net.PacketConn) error {
+	if !c.config.DNS {
+		return errors.New("ServeDNS() requires DNS")
+	}
+	inFlight := make(chan struct{}, dnsMaxQueriesInFlight)
+	buf := make([]byte, common.MaxDatagramSize)
+	for {
+		n, peer, err := pconn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-c.closed:
+				return ErrClosed
+			default:
+			}
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				continue
+			}
+			log.Print("Failed to read from the DNS socket", err)
+			return err
+		}
+		select {
+		case inFlight <- struct{}{}:
+		default:
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			defer func() { <-inFlight }()
+			response := c.answerDNS(query)
+			if response == nil {
+				return
+			}
+			response = truncateDNSResponse(response, maxDNSUDPResponseSize(query))
+			if _, err := pconn.WriteTo(response, peer); err != nil {
+				log.Printf("Failed to send a DNS response to %v: %v", peer, err)
+			}
+		}()
+	}
+}
+
+// ServeDNSTCP is like `ServeDNS()`, but for DNS over TCP.
+// It returns when `ln.Accept()` fails or the client is closed.
+// `ln` is not closed.
+func (c *Client) ServeDNSTCP(ln net.Listener) error {
+	if !c.config.DNS {
+		return errors.New("ServeDNSTCP() requires DNS")
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-c.closed:
+				return ErrClosed
+			default:
+			}
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				continue
+			}
+			log.Print("Failed to accept DNS connection", err)
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			stopClosing := make(chan struct{})
+			defer close(stopClosing)
+			go func() {
+				select {
+				case <-c.closed:
+					conn.Close()
+				case <-stopClosing:
+				}
+			}()
+			c.serveDNSTCPConn(conn)
+		}()
+	}
+}
+
+// Queries may be pipelined, so they're answered concurrently,
+// as RFC 7766 recommends.
+func (c *Client) serveDNSTCPConn(conn net.Conn) {
+	var writeMu sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	inFlight := make(chan struct{}, dnsMaxQueriesInFlight)
+	for {
+		conn.SetReadDeadline(time.Now().Add(dnsTCPIdleTimeout))
+		query, err := readDNSOverTCP(conn)
+		if err != nil {
+			return
+		}
+		inFlight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-inFlight }()
+			response := c.answerDNS(query)
+			if response == nil {
+				return
+			}
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			if err := writeDNSOverTCP(conn, response); err != nil {
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// Returns the response to the DNS `query`, or a "server failure" response
+// if it couldn't be resolved, or `nil` if the query is malformed.
+func (c *Client) answerDNS(query []byte) []byte {
+	response, err := c.resolveDNS(query)
+	if err == nil {
+		return response
+	}
+	log.Print("Failed to resolve a DNS query: ", err)
+	response, err = dnsServerFailure(query)
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+// Returns the response to the DNS `query`, from the cache
+// or from the server's resolver.
+func (c *Client) resolveDNS(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	question, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	key := newDNSCacheKey(question, header)
+	if response := c.dnsCache.get(key, header.ID); response != nil {
+		return response, nil
+	}
+
+	response, err := c.exchangeDNS(query)
+	if err != nil {
+		return nil, err
+	}
+	c.dnsCache.put(key, response)
+	return response, nil
+}
+
+// Sends the query to the server's resolver in a new stream.
+func (c *Client) exchangeDNS(query []byte) ([]byte, error) {
+	stream, err := c.openStream(common.StreamTypeDNS)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(dnsQueryTimeout))
+	if err := writeDNSOverTCP(stream, query); err != nil {
+		return nil, err
+	}
+	return readDNSOverTCP(stream)
+}
+
+// Reads a message prefixed with its length.
+func readDNSOverTCP(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeDNSOverTCP(w io.Writer, msg []byte) error {
+	if len(msg) > 0xffff {
+		return fmt.Errorf("the DNS message is too long: %v bytes", len(msg))
+	}
+	framed := make([]byte, 0, 2+len(msg))
+	framed = binary.BigEndian.AppendUint16(framed, uint16(len(msg)))
+	framed = append(framed, msg...)
+	_, err := w.Write(framed)
+	return err
+}
+
+// Returns the "server failure" response to `query`.
+func dnsServerFailure(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, err
+	}
+	response := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 header.ID,
+			Response:           true,
+			OpCode:             header.OpCode,
+			RecursionDesired:   header.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              dnsmessage.RCodeServerFailure,
+		},
+		Questions: questions,
+	}
+	return response.Pack()
+}
+
+// Returns how big a UDP response the sender of `query` accepts.
+func maxDNSUDPResponseSize(query []byte) int {
+	var p dnsmessage.Parser
+	if _, err := p.Start(query); err != nil {
+		return dnsMinUDPSize
+	}
+	if p.SkipAllQuestions() != nil ||
+		p.SkipAllAnswers() != nil ||
+		p.SkipAllAuthorities() != nil {
+		return dnsMinUDPSize
+	}
+	for {
+		header, err := p.AdditionalHeader()
+		if err != nil {
+			return dnsMinUDPSize
+		}
+		if header.Type == dnsmessage.TypeOPT {
+			// For OPT the class is the UDP payload size.
+			return max(int(header.Class), dnsMinUDPSize)
+		}
+		if err := p.SkipAdditional(); err != nil {
+			return dnsMinUDPSize
+		}
+	}
+}
+
+// If `response` is bigger than `limit`, returns it without the records
+// and with the "truncated" flag, so that the client retries over TCP.
+func truncateDNSResponse(response []byte, limit int) []byte {
+	if len(response) <= limit {
+		return response
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		return response
+	}
+	msg.Header.Truncated = true
+	msg.Answers = nil
+	msg.Authorities = nil
+	msg.Additionals = nil
+	truncated, err := msg.Pack()
+	if err != nil {
+		return response
+	}
+	return truncated
+}
+
+// Queries with the same key get the same response.
+type dnsCacheKey struct {
+	question dnsmessage.Question
+	// Asks the resolver not to validate DNSSEC.
+	checkingDisabled bool
+}
+
+func newDNSCacheKey(question dnsmessage.Question, header dnsmessage.Header) dnsCacheKey {
+	// Names are case-insensitive.
+	name := question.Name.Data[:question.Name.Length]
+	for i, b := range name {
+		if 'A' <= b && b <= 'Z' {
+			name[i] = b + 'a' - 'A'
+		}
+	}
+	return dnsCacheKey{
+		question:         question,
+		checkingDisabled: header.CheckingDisabled,
+	}
+}
+
+type dnsCacheEntry struct {
+	response []byte
+	added    time.Time
+	expires  time.Time
+}
+
+// A small cache of successful DNS responses.
+type dnsCache struct {
+	mu      sync.Mutex
+	entries map[dnsCacheKey]*dnsCacheEntry
+}
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{entries: make(map[dnsCacheKey]*dnsCacheEntry)}
+}
+
+// Returns the cached response with the ID of the query,
+// and with the TTLs decreased by the time it has been cached for.
+// Returns `nil` if there is none.
+func (c *dnsCache) get(key dnsCacheKey, id uint16) []byte {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && !time.Now().Before(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(entry.response); err != nil {
+		return nil
+	}
+	msg.Header.ID = id
+	age := uint32(time.Since(entry.added) / time.Second)
+	for _, section := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for i := range section {
+			header := &section[i].Header
+			if header.Type == dnsmessage.TypeOPT {
+				// Its TTL field is not a TTL.
+				continue
+			}
+			header.TTL -= min(age, header.TTL)
+		}
+	}
+	response, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+// Caches the response if it has answers, for the smallest of their TTLs.
+func (c *dnsCache) put(key dnsCacheKey, response []byte) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		return
+	}
+	if msg.Header.RCode != dnsmessage.RCodeSuccess ||
+		msg.Header.Truncated ||
+		len(msg.Answers) == 0 {
+		return
+	}
+	ttl := dnsCacheMaxTTL
+	for _, answer := range msg.Answers {
+		ttl = min(ttl, time.Duration(answer.Header.TTL)*time.Second)
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= dnsCacheSize {
+		var soonest dnsCacheKey
+		var soonestEntry *dnsCacheEntry
+		for other, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, other)
+				continue
+			}
+			if soonestEntry == nil || entry.expires.Before(soonestEntry.expires) {
+				soonest, soonestEntry = other, entry
+			}
+		}
+		if len(c.entries) >= dnsCacheSize {
+			delete(c.entries, soonest)
+		}
+	}
+	c.entries[key] = &dnsCacheEntry{
+		response: response,
+		added:    now,
+		expires:  now.Add(ttl),
+	}
+}
@@ -0,0 +1,275 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	snowflakeClient "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/client/lib"
+)
+
+// Endpoint is a server and the broker through which to connect to it.
+type Endpoint struct {
+	BrokerURL string `json:"brokerUrl"`
+	// Specify either `RelayURL` or `BridgeFingerprint`.
+	RelayURL          string `json:"relayUrl,omitempty"`
+	BridgeFingerprint string `json:"bridgeFingerprint,omitempty"`
+}
+
+func (e Endpoint) String() string {
+	server := e.RelayURL
+	if server == "" {
+		server = "with ID " + e.BridgeFingerprint
+	}
+	return fmt.Sprintf("server %v (broker %v)", server, e.BrokerURL)
+}
+
+func (e Endpoint) validate() error {
+	if e.RelayURL == "" && e.BridgeFingerprint == "" {
+		return errors.New("specify RelayURL or BridgeFingerprint")
+	}
+	return nil
+}
+
+// Identifies the server, regardless of the broker.
+func (e Endpoint) serverKey() string {
+	return e.RelayURL + "|" + e.BridgeFingerprint
+}
+
+// A session that dies sooner than this after it has been established
+// counts as a failure of the endpoint.
+const healthySessionLifetime = time.Minute
+
+// Keeps track of which endpoint to use,
+// and holds a `snowflakeClient.Transport` for each of them.
+type endpointRotator struct {
+	baseConfig             snowflakeClient.ClientConfig
+	stateFile              string
+	failuresBeforeRotation int
+
+	mu           sync.Mutex
+	endpoints    []Endpoint
+	transports   []*snowflakeClient.Transport
+	currentIndex int
+	// Consecutive short-lived sessions with the current endpoint.
+	sessionFailures int
+	// The index of the endpoint that is in the state file, or -1.
+	saved int
+}
+
+func newEndpointRotator(config Config) (*endpointRotator, error) {
+	endpoints := slices.Clone(config.Endpoints)
+	if len(endpoints) == 0 {
+		endpoints = []Endpoint{{
+			BrokerURL:         config.Snowflake.BrokerURL,
+			RelayURL:          config.Snowflake.RelayURL,
+			BridgeFingerprint: config.Snowflake.BridgeFingerprint,
+		}}
+	}
+	for _, endpoint := range endpoints {
+		if err := endpoint.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.ShuffleEndpoints {
+		rand.Shuffle(len(endpoints), func(i, j int) {
+			endpoints[i], endpoints[j] = endpoints[j], endpoints[i]
+		})
+	}
+	failuresBeforeRotation := config.SessionFailuresBeforeRotation
+	if failuresBeforeRotation == 0 {
+		failuresBeforeRotation = 3
+	}
+
+	r := &endpointRotator{
+		baseConfig:             config.Snowflake,
+		stateFile:              config.StateFile,
+		failuresBeforeRotation: failuresBeforeRotation,
+		endpoints:              endpoints,
+		transports:             make([]*snowflakeClient.Transport, len(endpoints)),
+		saved:                  -1,
+	}
+	if r.stateFile != "" {
+		r.loadState()
+	}
+	return r, nil
+}
+
+type endpointState struct {
+	LastWorking Endpoint `json:"lastWorking"`
+}
+
+// Makes the endpoint from the state file the current one,
+// if it is still in the list.
+func (r *endpointRotator) loadState() {
+	data, err := os.ReadFile(r.stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to read the state file: %v", err)
+		return
+	}
+	var state endpointState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Printf("Failed to parse the state file %v: %v", r.stateFile, err)
+		return
+	}
+	i := slices.Index(r.endpoints, state.LastWorking)
+	if i < 0 {
+		return
+	}
+	r.currentIndex = i
+	r.saved = i
+	if len(r.endpoints) > 1 {
+		log.Printf("Starting with the last working %v", r.endpoints[i])
+	}
+}
+
+// Must be called with `r.mu` held.
+func (r *endpointRotator) saveStateLocked() {
+	data, err := json.Marshal(endpointState{LastWorking: r.endpoints[r.currentIndex]})
+	if err != nil {
+		log.Printf("Failed to save the state: %v", err)
+		return
+	}
+	// Write to a temporary file first so that the state file
+	// doesn't get corrupted if we crash.
+	tmp, err := os.CreateTemp(filepath.Dir(r.stateFile), filepath.Base(r.stateFile)+".tmp*")
+	if err != nil {
+		log.Printf("Failed to save the state: %v", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), r.stateFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("Failed to save the state: %v", err)
+		return
+	}
+	r.saved = r.currentIndex
+}
+
+func (r *endpointRotator) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.endpoints)
+}
+
+func (r *endpointRotator) list() []Endpoint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.endpoints)
+}
+
+// Returns the current endpoint and its index.
+func (r *endpointRotator) current() (int, Endpoint) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.currentIndex, r.endpoints[r.currentIndex]
+}
+
+// Returns the transport for endpoint `i`, creating it if needed.
+// Keep in mind that `Transport.Dial()` closes the connection
+// previously returned by the same transport.
+func (r *endpointRotator) sharedTransport(i int) (*snowflakeClient.Transport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.transports[i] == nil {
+		transport, err := r.newTransport(r.endpoints[i])
+		if err != nil {
+			return nil, err
+		}
+		r.transports[i] = transport
+	}
+	return r.transports[i], nil
+}
+
+// Creates a transport that is not shared with anybody.
+func (r *endpointRotator) newTransport(endpoint Endpoint) (*snowflakeClient.Transport, error) {
+	config := r.baseConfig
+	config.BrokerURL = endpoint.BrokerURL
+	config.RelayURL = endpoint.RelayURL
+	config.BridgeFingerprint = endpoint.BridgeFingerprint
+	return snowflakeClient.NewSnowflakeClient(config)
+}
+
+// Switches to the endpoint that follows `failed`,
+// unless that has already been done.
+func (r *endpointRotator) rotate(failed int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.currentIndex != failed || len(r.endpoints) == 1 {
+		return
+	}
+	r.currentIndex = (r.currentIndex + 1) % len(r.endpoints)
+	r.sessionFailures = 0
+	log.Printf("Switching to %v", r.endpoints[r.currentIndex])
+}
+
+// Makes `endpoint` the current one, adding it to the list
+// if it's not there.
+func (r *endpointRotator) switchTo(endpoint Endpoint) error {
+	if err := endpoint.validate(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.Index(r.endpoints, endpoint)
+	if i < 0 {
+		r.endpoints = append(r.endpoints, endpoint)
+		r.transports = append(r.transports, nil)
+		i = len(r.endpoints) - 1
+	}
+	r.currentIndex = i
+	r.sessionFailures = 0
+	log.Printf("Switching to %v", endpoint)
+	return nil
+}
+
+// Records that a connection through endpoint `i` has been established.
+func (r *endpointRotator) succeeded(i int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.currentIndex != i || r.saved == i || r.stateFile == "" {
+		return
+	}
+	r.saveStateLocked()
+}
+
+// Records that the session with the current endpoint has ended,
+// and rotates if that keeps happening too soon.
+func (r *endpointRotator) sessionDied(lifetime time.Duration) {
+	r.mu.Lock()
+	if lifetime >= healthySessionLifetime {
+		r.sessionFailures = 0
+		r.mu.Unlock()
+		return
+	}
+	r.sessionFailures++
+	current := r.currentIndex
+	endpoint := r.endpoints[current]
+	tooMany := r.sessionFailures >= r.failuresBeforeRotation
+	r.mu.Unlock()
+
+	if tooMany {
+		log.Printf(
+			"The session with %v died too soon %v times in a row",
+			endpoint,
+			r.failuresBeforeRotation,
+		)
+		r.rotate(current)
+	}
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"log"
+	"net"
+
+	"github.com/WofWca/snowflake-generalized/common"
+)
+
+// Forward accepts connections from `ln` and forwards them to the server.
+// It returns when `ln.Accept()` fails or the client is closed.
+// Failing to connect to the server doesn't stop it,
+// only the local connections that couldn't be forwarded are closed.
+// `ln` is not closed.
+//
+// At most `Config.MaxConnections` connections are forwarded at a time,
+// the rest wait to be accepted.
+func (c *Client) Forward(ln net.Listener) error {
+	return c.forward(ln, func(net.Conn) (net.Conn, error) {
+		return c.Dial()
+	})
+}
+
+// The accept loop of `Forward()`. `dial` connects to the server
+// for the accepted connection.
+func (c *Client) forward(ln net.Listener, dial func(net.Conn) (net.Conn, error)) error {
+	var slots chan struct{}
+	if c.config.MaxConnections > 0 {
+		slots = make(chan struct{}, c.config.MaxConnections)
+	}
+	releaseSlot := func() {
+		if slots != nil {
+			<-slots
+		}
+	}
+
+	for {
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			case <-c.closed:
+				return ErrClosed
+			}
+		}
+
+		netConn, err := ln.Accept()
+		if err != nil {
+			releaseSlot()
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				continue
+			}
+			log.Print("Failed to accept connection", err)
+			return err
+		}
+		log.Printf(
+			"Got new connection from %v! Forwarding",
+			netConn.RemoteAddr().String(),
+		)
+
+		go func() {
+			defer releaseSlot()
+			defer netConn.Close()
+			// In single-connection mode this establishes a whole new
+			// Snowflake connection, which might take a while.
+			snowflakeConn, err := dial(netConn)
+			if err != nil {
+				log.Printf(
+					"Failed to forward connection from %v: %v",
+					netConn.RemoteAddr().String(),
+					err,
+				)
+				return
+			}
+			defer snowflakeConn.Close()
+
+			common.CopyLoop(snowflakeConn, netConn, c.closed)
+			if c.config.SingleConnMode {
+				log.Printf("Connection ended %v", netConn.RemoteAddr().String())
+			} else {
+				log.Printf(
+					"Connection ended %v (stream %v)",
+					netConn.RemoteAddr().String(),
+					streamID(snowflakeConn),
+				)
+			}
+		}()
+	}
+}
+
+// Returns the smux stream ID of a connection returned by `Dial()`
+// in mux mode.
+func streamID(conn net.Conn) interface{} {
+	if stream, ok := conn.(interface{ ID() uint32 }); ok {
+		return stream.ID()
+	}
+	return "unknown"
+}
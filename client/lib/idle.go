@@ -0,0 +1,147 @@
+package client
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/WofWca/snowflake-generalized/common"
+	"github.com/xtaci/smux"
+)
+
+// Opens a stream in `muxSession` and counts it in `activeStreams`.
+// Returns `nil, nil` if `muxSession` is not the session of `slot` anymore.
+func (c *Client) openTrackedStream(
+	slot *muxSessionSlot,
+	muxSession *smux.Session,
+) (*trackedStream, error) {
+	c.mu.Lock()
+	if slot.session != muxSession {
+		c.mu.Unlock()
+		return nil, nil
+	}
+	handshakeResult := slot.handshakeResult
+	// Count it before it's opened, so that the session
+	// doesn't get closed for being idle in the meantime.
+	c.activeStreams++
+	slot.activeStreams++
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+		c.idleTimer = nil
+	}
+	c.mu.Unlock()
+
+	stream, err := muxSession.OpenStream()
+	if err != nil {
+		c.streamClosed(slot)
+		return nil, err
+	}
+	return &trackedStream{
+		Stream:          stream,
+		client:          c,
+		slot:            slot,
+		openedAt:        time.Now(),
+		handshakeResult: handshakeResult,
+	}, nil
+}
+
+func (c *Client) streamClosed(slot *muxSessionSlot) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.activeStreams--
+	slot.activeStreams--
+	c.startIdleTimerLocked()
+}
+
+// Must be called with `c.mu` held.
+func (c *Client) startIdleTimerLocked() {
+	if c.config.IdleTimeout <= 0 || c.activeStreams > 0 || c.idleTimer != nil {
+		return
+	}
+	for _, slot := range c.sessions {
+		if slot.session != nil {
+			c.idleTimer = time.AfterFunc(c.config.IdleTimeout, c.closeIdleSessions)
+			return
+		}
+	}
+}
+
+func (c *Client) closeIdleSessions() {
+	c.mu.Lock()
+	if c.activeStreams > 0 {
+		c.mu.Unlock()
+		return
+	}
+	var muxSessions []*smux.Session
+	for _, slot := range c.sessions {
+		if slot.session != nil {
+			muxSessions = append(muxSessions, slot.session)
+			// So that it's not considered lost.
+			slot.session = nil
+		}
+	}
+	c.idleTimer = nil
+	c.mu.Unlock()
+	if len(muxSessions) == 0 {
+		return
+	}
+
+	log.Printf(
+		"No connections for %v, closing the Snowflake connection until the next one",
+		c.config.IdleTimeout,
+	)
+	for _, muxSession := range muxSessions {
+		muxSession.Close()
+	}
+}
+
+// Keeps track of `Client.activeStreams` and measures the latency.
+type trackedStream struct {
+	*smux.Stream
+	client       *Client
+	slot         *muxSessionSlot
+	openedAt     time.Time
+	gotFirstByte bool
+	// See `muxSessionSlot.handshakeResult`.
+	handshakeResult *common.HandshakeResult
+	closeOnce       sync.Once
+}
+
+// Must not be called concurrently, which `io.Copy` doesn't do.
+func (s *trackedStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	s.received(n)
+	return n, err
+}
+
+// `io.Copy` (and so `common.CopyLoop`) uses this instead of `Read()`,
+// because `smux.Stream` implements it.
+func (s *trackedStream) WriteTo(w io.Writer) (int64, error) {
+	return s.Stream.WriteTo(&firstByteWriter{Writer: w, stream: s})
+}
+
+func (s *trackedStream) received(n int) {
+	if n > 0 && !s.gotFirstByte {
+		s.gotFirstByte = true
+		s.client.recordLatency(s.slot, time.Since(s.openedAt))
+	}
+}
+
+// Tells `trackedStream` about the data that `smux.Stream.WriteTo()` writes.
+type firstByteWriter struct {
+	io.Writer
+	stream *trackedStream
+}
+
+func (w *firstByteWriter) Write(b []byte) (int, error) {
+	w.stream.received(len(b))
+	return w.Writer.Write(b)
+}
+
+func (s *trackedStream) Close() error {
+	s.closeOnce.Do(func() {
+		s.client.streamClosed(s.slot)
+	})
+	return s.Stream.Close()
+}
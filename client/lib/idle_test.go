@@ -0,0 +1,110 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	snowflakeServer "github.com/WofWca/snowflake-generalized/server/lib"
+	snowflakeClient "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/client/lib"
+)
+
+// Creates a client whose Snowflake connections go straight
+// to an in-process server, instead of through a broker and a proxy.
+func newTestClient(
+	t *testing.T,
+	serverConfig snowflakeServer.Config,
+	clientConfig Config,
+) *Client {
+	t.Helper()
+	server := snowflakeServer.NewServer(serverConfig)
+	t.Cleanup(func() { server.Close() })
+
+	clientConfig.Snowflake = snowflakeClient.ClientConfig{
+		BrokerURL: "https://broker.invalid/",
+		RelayURL:  "wss://server.invalid/",
+	}
+	client, err := NewClient(clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	client.dialTransport = func(*snowflakeClient.Transport) (net.Conn, error) {
+		clientEnd, serverEnd := net.Pipe()
+		go server.ServeConn(serverEnd)
+		return clientEnd, nil
+	}
+	return client
+}
+
+func serveEcho(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+// The latency of a session is measured on the streams of `Forward()`,
+// which `common.CopyLoop` reads with `WriteTo()` rather than `Read()`.
+func TestForwardRecordsLatency(t *testing.T) {
+	const destination = "destination:7"
+	dialer := snowflakeServer.NewMemoryDialer()
+	destinationListener, err := dialer.Listen("tcp", destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer destinationListener.Close()
+	go serveEcho(destinationListener)
+
+	client := newTestClient(
+		t,
+		snowflakeServer.Config{
+			DestinationProtocol: "tcp",
+			DestinationAddress:  destination,
+			Dialer:              dialer,
+		},
+		Config{
+			DestinationProtocol: "tcp",
+			StripingStrategy:    LowestLatency,
+		},
+	)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go client.Forward(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	message := []byte("hello")
+	if _, err := conn.Write(message); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply, message) {
+		t.Fatalf("got %q, want %q", reply, message)
+	}
+
+	client.mu.Lock()
+	latency := client.sessions[0].latency
+	client.mu.Unlock()
+	if latency <= 0 {
+		t.Fatal("no latency sample has been recorded")
+	}
+}
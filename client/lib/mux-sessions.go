@@ -0,0 +1,366 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/WofWca/snowflake-generalized/common"
+	"github.com/xtaci/smux"
+)
+
+// StripingStrategy determines which of the `Config.Sessions`
+// a new stream goes to.
+type StripingStrategy string
+
+const (
+	// The session with the fewest open streams is used.
+	LeastStreams StripingStrategy = "least-streams"
+	// The session with the lowest latency is used.
+	// The latency is estimated as the time between opening a stream
+	// and receiving its first byte, so it's only meaningful
+	// for request-response protocols, such as HTTP over SOCKS.
+	LowestLatency StripingStrategy = "lowest-latency"
+)
+
+// StripingStrategies lists all the valid `StripingStrategy` values.
+var StripingStrategies = []StripingStrategy{LeastStreams, LowestLatency}
+
+// One of the `Config.Sessions`.
+type muxSessionSlot struct {
+	index int
+	// Serializes establishing the session.
+	establishMu sync.Mutex
+	// Whether the session is being established in the background.
+	establishing atomic.Bool
+
+	// Protected by `Client.mu`.
+	// `nil` until established, and after it's closed for being idle.
+	session       *smux.Session
+	establishedAt time.Time
+	// What has been negotiated for `session`.
+	handshakeResult *common.HandshakeResult
+	activeStreams   int
+	// Moving average of the time to the first byte of a stream.
+	// 0 if unknown.
+	latency time.Duration
+	// Closed when `session` is replaced by `Client.Reconnect()`.
+	replaced chan struct{}
+}
+
+func (slot *muxSessionSlot) isAlive() bool {
+	return slot.session != nil && !slot.session.IsClosed()
+}
+
+// Must be called with `slot.establishMu` held.
+func (c *Client) establishSessionLocked(ctx context.Context, slot *muxSessionSlot) error {
+	c.mu.Lock()
+	alreadyEstablished := slot.isAlive()
+	c.mu.Unlock()
+	if alreadyEstablished {
+		return nil
+	}
+
+	// The sessions exist simultaneously,
+	// so they can't share a transport. Neither can a session
+	// that `Reconnect()` has replaced and that is still draining.
+	c.mu.Lock()
+	ownTransport := len(c.sessions) > 1 || c.drainingSessions > 0
+	c.mu.Unlock()
+	muxSession, handshakeResult, err := c.dialMuxSession(ctx, ownTransport)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.closed:
+		muxSession.Close()
+		return ErrClosed
+	default:
+	}
+	c.setSessionLocked(slot, muxSession, handshakeResult)
+	if len(c.sessions) > 1 {
+		log.Printf("Session %v established", slot.index)
+	}
+	return nil
+}
+
+// Must be called with `c.mu` held.
+func (c *Client) setSessionLocked(
+	slot *muxSessionSlot,
+	muxSession *smux.Session,
+	handshakeResult *common.HandshakeResult,
+) {
+	slot.session = muxSession
+	slot.establishedAt = time.Now()
+	slot.handshakeResult = handshakeResult
+	slot.latency = 0
+	slot.replaced = make(chan struct{})
+	c.startIdleTimerLocked()
+}
+
+// Establishes a new Snowflake connection to the server
+// (or takes a standby one) and starts a mux session in it.
+// See `dialOptions.ownTransport`.
+func (c *Client) dialMuxSession(
+	ctx context.Context,
+	ownTransport bool,
+) (*smux.Session, *common.HandshakeResult, error) {
+	type dialResult struct {
+		dialed *dialedConn
+		err    error
+	}
+	// `Transport.Dial()` doesn't take a context, so let's at least
+	// not block the caller and clean up after it.
+	resultChan := make(chan dialResult, 1)
+	go func() {
+		if standby, ok := c.takeStandby(); ok {
+			resultChan <- dialResult{standby, nil}
+			return
+		}
+		dialed, err := c.connect(ctx, true, ownTransport)
+		resultChan <- dialResult{dialed, err}
+	}()
+	var res dialResult
+	var abortErr error
+	select {
+	case res = <-resultChan:
+	case <-ctx.Done():
+		abortErr = ctx.Err()
+	case <-c.closed:
+		abortErr = ErrClosed
+	}
+	if abortErr != nil {
+		go func() {
+			if res := <-resultChan; res.err == nil {
+				res.dialed.Close()
+			}
+		}()
+		return nil, nil, abortErr
+	}
+	if res.err != nil {
+		return nil, nil, res.err
+	}
+
+	muxSession, err := newMuxSession(res.dialed.Conn, res.dialed.result)
+	if err != nil {
+		res.dialed.Close()
+		return nil, nil, err
+	}
+	return muxSession, res.dialed.result, nil
+}
+
+// Reconnect moves the session with the index (see `Config.Sessions`),
+// or all the sessions if `index` is -1, to new Snowflake connections,
+// e.g. to get away from a slow proxy, or to apply `SwitchEndpoint()`.
+// The new streams go to the new connections right away,
+// and the old connections are closed once their streams have ended,
+// so the open streams are not interrupted.
+// Only in mux mode.
+func (c *Client) Reconnect(ctx context.Context, index int) error {
+	if c.config.SingleConnMode {
+		return errors.New("Reconnect() is only supported in mux mode")
+	}
+	if index < -1 || index >= len(c.sessions) {
+		return fmt.Errorf("no session %v", index)
+	}
+	slots := c.sessions
+	if index >= 0 {
+		slots = c.sessions[index : index+1]
+	}
+	errs := make(chan error, len(slots))
+	for _, slot := range slots {
+		go func() {
+			errs <- c.reconnectSession(ctx, slot)
+		}()
+	}
+	var err error
+	for range slots {
+		err = errors.Join(err, <-errs)
+	}
+	return err
+}
+
+func (c *Client) reconnectSession(ctx context.Context, slot *muxSessionSlot) error {
+	slot.establishMu.Lock()
+	defer slot.establishMu.Unlock()
+
+	// The old session keeps going until it's drained,
+	// so the new one must not close it by sharing its transport.
+	muxSession, handshakeResult, err := c.dialMuxSession(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	select {
+	case <-c.closed:
+		c.mu.Unlock()
+		muxSession.Close()
+		return ErrClosed
+	default:
+	}
+	old := slot.session
+	if old != nil {
+		close(slot.replaced)
+	}
+	c.setSessionLocked(slot, muxSession, handshakeResult)
+	if old != nil {
+		c.drainingSessions++
+	}
+	c.mu.Unlock()
+
+	log.Printf("Session %v moved to a new Snowflake connection", slot.index)
+	if old != nil {
+		go c.closeWhenDrained(old)
+	}
+	return nil
+}
+
+// Closes a session that `Reconnect()` has replaced,
+// once all its streams have been closed.
+// `Client.drainingSessions` must have been incremented for it.
+func (c *Client) closeWhenDrained(muxSession *smux.Session) {
+	defer func() {
+		c.mu.Lock()
+		c.drainingSessions--
+		c.mu.Unlock()
+	}()
+	defer muxSession.Close()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for muxSession.NumStreams() > 0 {
+		select {
+		case <-ticker.C:
+		case <-muxSession.CloseChan():
+			return
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// Picks the session for a new stream according to `Config.StripingStrategy`,
+// establishing it if none are alive.
+// The sessions that are not alive are established in the background.
+func (c *Client) getMuxSession() (*muxSessionSlot, *smux.Session, error) {
+	c.mu.Lock()
+	var best *muxSessionSlot
+	var notAlive []*muxSessionSlot
+	for _, slot := range c.sessions {
+		if !slot.isAlive() {
+			notAlive = append(notAlive, slot)
+			continue
+		}
+		if best == nil || c.isBetterSession(slot, best) {
+			best = slot
+		}
+	}
+	var muxSession *smux.Session
+	if best != nil {
+		muxSession = best.session
+	}
+	c.mu.Unlock()
+
+	if best != nil {
+		for _, slot := range notAlive {
+			c.reestablishSessionInBackground(slot)
+		}
+		return best, muxSession, nil
+	}
+
+	slot := notAlive[0]
+	for _, slot := range notAlive[1:] {
+		c.reestablishSessionInBackground(slot)
+	}
+	if c.config.FailFast {
+		c.reestablishSessionInBackground(slot)
+		return nil, nil, ErrNotConnected
+	}
+	muxSession, err := c.reestablishSession(slot)
+	return slot, muxSession, err
+}
+
+// Must be called with `c.mu` held.
+func (c *Client) isBetterSession(a, b *muxSessionSlot) bool {
+	if c.config.StripingStrategy == LowestLatency && a.latency != b.latency {
+		// Try the sessions with unknown latency first,
+		// so that it gets known.
+		if a.latency == 0 || b.latency == 0 {
+			return a.latency == 0
+		}
+		return a.latency < b.latency
+	}
+	return a.activeStreams < b.activeStreams
+}
+
+func (c *Client) reestablishSessionInBackground(slot *muxSessionSlot) {
+	if !slot.establishing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer slot.establishing.Store(false)
+		if _, err := c.reestablishSession(slot); err != nil && err != ErrClosed {
+			log.Print("Failed to connect to the server: ", err)
+		}
+	}()
+}
+
+func (c *Client) reestablishSession(slot *muxSessionSlot) (*smux.Session, error) {
+	slot.establishMu.Lock()
+	defer slot.establishMu.Unlock()
+	c.mu.Lock()
+	muxSession := slot.session
+	establishedAt := slot.establishedAt
+	c.mu.Unlock()
+	if muxSession != nil {
+		if !muxSession.IsClosed() {
+			// Somebody has re-established it already.
+			return muxSession, nil
+		}
+		lifetime := time.Since(establishedAt)
+		if len(c.sessions) > 1 {
+			log.Printf(
+				"Session %v to the server has been lost after %v. Reconnecting",
+				slot.index,
+				lifetime.Round(time.Second),
+			)
+		} else {
+			log.Printf(
+				"The Snowflake connection to the server has been lost after %v. Reconnecting",
+				lifetime.Round(time.Second),
+			)
+		}
+		c.endpoints.sessionDied(lifetime)
+		c.mu.Lock()
+		slot.session = nil
+		c.mu.Unlock()
+	}
+
+	if err := c.establishSessionLocked(context.Background(), slot); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slot.session, nil
+}
+
+// How much a new latency sample affects `muxSessionSlot.latency`.
+const latencySmoothing = 0.2
+
+func (c *Client) recordLatency(slot *muxSessionSlot, sample time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if slot.latency == 0 {
+		slot.latency = sample
+		return
+	}
+	slot.latency += time.Duration(latencySmoothing * float64(sample-slot.latency))
+}
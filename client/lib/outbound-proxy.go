@@ -0,0 +1,432 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/WofWca/snowflake-generalized/common"
+)
+
+// The Snowflake library doesn't let us control its sockets,
+// but it can send all of its traffic (to the broker, STUN servers
+// and proxies) through a SOCKS5 proxy, `ClientConfig.CommunicationProxy`.
+// So, to apply `Config.SocketMark` and `Config.BindInterface`,
+// we run a SOCKS5 proxy on the loopback interface
+// that makes its outgoing connections with these options.
+//
+// It only supports what the Snowflake library needs:
+// username/password authentication, CONNECT and UDP ASSOCIATE.
+// The credentials are random, and only the Snowflake library gets them
+// (see `url()`), so that other local users can't use the proxy
+// to bypass the VPN.
+type outboundProxy struct {
+	ln        net.Listener
+	dialer    *net.Dialer
+	listenUDP func() (net.PacketConn, error)
+	username  string
+	password  string
+}
+
+func newOutboundProxy(mark uint32, ifaceName string) (*outboundProxy, error) {
+	if err := checkOutboundOptionsSupported(); err != nil {
+		return nil, err
+	}
+	control := outboundControl(mark, ifaceName)
+	dialer := &net.Dialer{Control: control}
+	// So that DNS queries also bypass the VPN.
+	dialer.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return (&net.Dialer{Control: control}).DialContext(ctx, network, address)
+		},
+	}
+	listenConfig := &net.ListenConfig{Control: control}
+
+	// Check that the options can be applied at all
+	// (e.g. `SO_MARK` requires `CAP_NET_ADMIN`), so that we fail early.
+	testConn, err := listenConfig.ListenPacket(context.Background(), "udp", ":0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply the socket options: %w", err)
+	}
+	testConn.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &outboundProxy{
+		ln:     ln,
+		dialer: dialer,
+		listenUDP: func() (net.PacketConn, error) {
+			return listenConfig.ListenPacket(context.Background(), "udp", ":0")
+		},
+		username: randomHex(8),
+		password: randomHex(16),
+	}
+	go p.serve()
+	return p, nil
+}
+
+// The value for `ClientConfig.CommunicationProxy`.
+func (p *outboundProxy) url() *url.URL {
+	return &url.URL{
+		Scheme: "socks5",
+		User:   url.UserPassword(p.username, p.password),
+		Host:   p.ln.Addr().String(),
+	}
+}
+
+func randomHex(size int) string {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (p *outboundProxy) Close() error {
+	return p.ln.Close()
+}
+
+func (p *outboundProxy) serve() {
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Print("Outbound proxy: failed to accept connection: ", err)
+			}
+			return
+		}
+		go func() {
+			defer conn.Close()
+			if err := p.serveConn(conn); err != nil {
+				log.Print("Outbound proxy: ", err)
+			}
+		}()
+	}
+}
+
+const (
+	socks5Version = 5
+
+	socks5AuthPassword     = 2
+	socks5AuthNoAcceptable = 0xff
+
+	// See RFC 1929.
+	socks5PasswordVersion = 1
+	socks5PasswordSuccess = 0
+	socks5PasswordFailure = 1
+
+	socks5CmdConnect      = 1
+	socks5CmdUDPAssociate = 3
+
+	socks5AddrIPv4   = 1
+	socks5AddrDomain = 3
+	socks5AddrIPv6   = 4
+
+	socks5ReplySucceeded          = 0
+	socks5ReplyGeneralFailure     = 1
+	socks5ReplyHostUnreachable    = 4
+	socks5ReplyCommandUnsupported = 7
+)
+
+func (p *outboundProxy) serveConn(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(common.HandshakeTimeout))
+
+	var greeting [2]byte
+	if _, err := io.ReadFull(conn, greeting[:]); err != nil {
+		return err
+	}
+	if greeting[0] != socks5Version {
+		return fmt.Errorf("unsupported SOCKS version %v", greeting[0])
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	method := byte(socks5AuthNoAcceptable)
+	for _, m := range methods {
+		if m == socks5AuthPassword {
+			method = socks5AuthPassword
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return err
+	}
+	if method == socks5AuthNoAcceptable {
+		return errors.New("no acceptable authentication method")
+	}
+	if err := p.authenticate(conn); err != nil {
+		return err
+	}
+
+	var header [3]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	address, err := readSocks5Address(conn)
+	if err != nil {
+		return err
+	}
+
+	switch header[1] {
+	case socks5CmdConnect:
+		return p.connect(conn, address)
+	case socks5CmdUDPAssociate:
+		return p.associateUDP(conn)
+	default:
+		writeSocks5Reply(conn, socks5ReplyCommandUnsupported, nil)
+		return fmt.Errorf("unsupported command %v", header[1])
+	}
+}
+
+// Performs the username/password subnegotiation, see RFC 1929.
+func (p *outboundProxy) authenticate(conn net.Conn) error {
+	var version [1]byte
+	if _, err := io.ReadFull(conn, version[:]); err != nil {
+		return err
+	}
+	if version[0] != socks5PasswordVersion {
+		return fmt.Errorf("unsupported username/password authentication version %v", version[0])
+	}
+	username, err := readSocks5String(conn)
+	if err != nil {
+		return err
+	}
+	password, err := readSocks5String(conn)
+	if err != nil {
+		return err
+	}
+	usernameOK := subtle.ConstantTimeCompare(username, []byte(p.username))
+	passwordOK := subtle.ConstantTimeCompare(password, []byte(p.password))
+	if usernameOK&passwordOK != 1 {
+		conn.Write([]byte{socks5PasswordVersion, socks5PasswordFailure})
+		return errors.New("wrong username or password")
+	}
+	_, err = conn.Write([]byte{socks5PasswordVersion, socks5PasswordSuccess})
+	return err
+}
+
+// Reads a string prefixed with its length byte.
+func readSocks5String(r io.Reader) ([]byte, error) {
+	var size [1]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, size[0])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (p *outboundProxy) connect(conn net.Conn, address string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), common.HandshakeTimeout)
+	defer cancel()
+	target, err := p.dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		writeSocks5Reply(conn, socks5ReplyHostUnreachable, nil)
+		return err
+	}
+	defer target.Close()
+	if err := writeSocks5Reply(conn, socks5ReplySucceeded, target.LocalAddr()); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	common.CopyLoop(conn, target, nil)
+	return nil
+}
+
+// Relays datagrams between the client and the targets
+// until the client closes the control connection.
+func (p *outboundProxy) associateUDP(conn net.Conn) error {
+	// The client is on the loopback interface,
+	// so this side doesn't need the options.
+	clientSide, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		writeSocks5Reply(conn, socks5ReplyGeneralFailure, nil)
+		return err
+	}
+	defer clientSide.Close()
+	targetSide, err := p.listenUDP()
+	if err != nil {
+		writeSocks5Reply(conn, socks5ReplyGeneralFailure, nil)
+		return err
+	}
+	defer targetSide.Close()
+	if err := writeSocks5Reply(conn, socks5ReplySucceeded, clientSide.LocalAddr()); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	clientAddrChan := make(chan net.Addr, 1)
+	go func() {
+		defer targetSide.Close()
+		defer clientSide.Close()
+		var clientAddr net.Addr
+		buf := make([]byte, common.MaxDatagramSize)
+		for {
+			n, from, err := clientSide.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if clientAddr == nil {
+				clientAddr = from
+				clientAddrChan <- from
+			} else if from.String() != clientAddr.String() {
+				// Somebody else who has found the port.
+				continue
+			}
+			target, payload, err := parseSocks5Datagram(buf[:n])
+			if err != nil {
+				continue
+			}
+			targetAddr, err := p.resolveUDPAddr(target)
+			if err != nil {
+				continue
+			}
+			targetSide.WriteTo(payload, targetAddr)
+		}
+	}()
+	go func() {
+		defer targetSide.Close()
+		defer clientSide.Close()
+		var clientAddr net.Addr
+		buf := make([]byte, common.MaxDatagramSize)
+		for {
+			n, from, err := targetSide.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if clientAddr == nil {
+				select {
+				case clientAddr = <-clientAddrChan:
+				default:
+					// Not ours to forward yet.
+					continue
+				}
+			}
+			datagram := appendSocks5Address([]byte{0, 0, 0}, from)
+			datagram = append(datagram, buf[:n]...)
+			clientSide.WriteTo(datagram, clientAddr)
+		}
+	}()
+
+	// The association ends when the control connection is closed.
+	io.Copy(io.Discard, conn)
+	return nil
+}
+
+func (p *outboundProxy) resolveUDPAddr(address string) (*net.UDPAddr, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ips, err := p.dialer.Resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses for %v", host)
+	}
+	return &net.UDPAddr{IP: ips[0].IP, Port: port}, nil
+}
+
+// Reads ATYP, ADDR and PORT.
+func readSocks5Address(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		size := net.IPv4len
+		if atyp[0] == socks5AddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		domain, err := readSocks5String(r)
+		if err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("unsupported address type %v", atyp[0])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// Appends ATYP, ADDR and PORT.
+func appendSocks5Address(b []byte, addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = addr.IP, addr.Port
+	case *net.UDPAddr:
+		ip, port = addr.IP, addr.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socks5AddrIPv4)
+		b = append(b, ip4...)
+	} else if ip16 := ip.To16(); ip16 != nil {
+		b = append(b, socks5AddrIPv6)
+		b = append(b, ip16...)
+	} else {
+		b = append(b, socks5AddrIPv4, 0, 0, 0, 0)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+func writeSocks5Reply(w io.Writer, reply byte, bound net.Addr) error {
+	msg := appendSocks5Address([]byte{socks5Version, reply, 0}, bound)
+	_, err := w.Write(msg)
+	return err
+}
+
+// Parses a UDP ASSOCIATE datagram, see RFC 1928, section 7.
+func parseSocks5Datagram(datagram []byte) (target string, payload []byte, err error) {
+	if len(datagram) < 4 {
+		return "", nil, errors.New("SOCKS5 UDP datagram is too short")
+	}
+	if datagram[2] != 0 {
+		return "", nil, errors.New("fragmented SOCKS5 UDP datagrams are not supported")
+	}
+	r := bytes.NewReader(datagram[3:])
+	target, err = readSocks5Address(r)
+	if err != nil {
+		return "", nil, err
+	}
+	return target, datagram[len(datagram)-r.Len():], nil
+}
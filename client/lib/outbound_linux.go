@@ -0,0 +1,42 @@
+package client
+
+import (
+	"syscall"
+)
+
+func checkOutboundOptionsSupported() error {
+	return nil
+}
+
+// Returns the `net.Dialer.Control` that applies `Config.SocketMark`
+// and `Config.BindInterface`.
+func outboundControl(mark uint32, ifaceName string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			if mark != 0 {
+				sockErr = syscall.SetsockoptInt(
+					int(fd),
+					syscall.SOL_SOCKET,
+					syscall.SO_MARK,
+					int(mark),
+				)
+				if sockErr != nil {
+					return
+				}
+			}
+			if ifaceName != "" {
+				sockErr = syscall.SetsockoptString(
+					int(fd),
+					syscall.SOL_SOCKET,
+					syscall.SO_BINDTODEVICE,
+					ifaceName,
+				)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package client
+
+import (
+	"errors"
+	"syscall"
+)
+
+func checkOutboundOptionsSupported() error {
+	return errors.New("marking sockets and binding them to an interface is only supported on Linux")
+}
+
+func outboundControl(mark uint32, ifaceName string) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"time"
+)
+
+// RetryPolicy defines how connecting to the server is retried.
+// The zero value retries forever, with delays from 1 second to 1 minute.
+type RetryPolicy struct {
+	// InitialDelay is the delay before the first retry. Defaults to 1 second.
+	InitialDelay time.Duration
+	// MaxDelay caps the delay, which doubles with every attempt.
+	// Defaults to 1 minute.
+	MaxDelay time.Duration
+	// MaxAttempts is how many times to try to connect before giving up,
+	// counting the first attempt. 0 means retry forever.
+	// Every attempt goes through all the endpoints once.
+	MaxAttempts int
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.InitialDelay == 0 {
+		p.InitialDelay = time.Second
+	}
+	if p.MaxDelay == 0 {
+		p.MaxDelay = time.Minute
+	}
+	return p
+}
+
+// Returns the delay after attempt number `attempt` (starting from 1) failed.
+// The delay is randomized between a half and the full value, so that
+// many clients that lost the connection at the same time
+// don't come back at the same time.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	delay := p.InitialDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, p.MaxDelay)
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// Calls `dialSnowflake()` until it succeeds,
+// or `MaxAttempts` is exhausted, or `ctx` is done, or the client is closed.
+func (c *Client) dialSnowflakeWithRetry(
+	ctx context.Context,
+	opts dialOptions,
+) (*dialedConn, error) {
+	policy := c.config.Retry
+	for attempt := 1; ; attempt++ {
+		dialed, err := c.dialSnowflake(opts)
+		if err == nil {
+			return dialed, nil
+		}
+		if err == ErrClosed {
+			return nil, err
+		}
+		if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+			return nil, fmt.Errorf("giving up after %v attempts: %w", attempt, err)
+		}
+
+		delay := policy.delay(attempt)
+		log.Printf(
+			"Failed to connect to the server (attempt %v): %v. Retrying in %v",
+			attempt,
+			err,
+			delay.Round(time.Millisecond),
+		)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-c.closed:
+			timer.Stop()
+			return nil, ErrClosed
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/WofWca/snowflake-generalized/common"
+	"github.com/xtaci/smux"
+)
+
+// ErrReverseNotSupported is returned by `ServeReverse()`
+// if the server doesn't forward connections to the client.
+var ErrReverseNotSupported = errors.New("the server doesn't forward connections to the client")
+
+// ServeReverse forwards the connections that the server accepts
+// on its reverse listener to the TCP `address`, like `ssh -R`.
+// See `common.FeatureReverse`. Requires `Config.Reverse`.
+//
+// It keeps all the `Config.Sessions` established, reconnecting
+// when they're lost, because the server can only reach the client
+// through them.
+// It returns when the client is closed,
+// or if the server doesn't support it.
+func (c *Client) ServeReverse(address string) error {
+	if !c.config.Reverse {
+		return errors.New("ServeReverse() requires Reverse")
+	}
+	errs := make(chan error, len(c.sessions))
+	for _, slot := range c.sessions {
+		go func() {
+			errs <- c.serveReverseSession(slot, address)
+		}()
+	}
+	for range c.sessions {
+		if err := <-errs; err != ErrClosed {
+			return err
+		}
+	}
+	return ErrClosed
+}
+
+// Accepts the server's streams in the session of `slot`,
+// re-establishing it when it's lost.
+func (c *Client) serveReverseSession(slot *muxSessionSlot, address string) error {
+	for {
+		muxSession, err := c.reestablishSession(slot)
+		if err != nil {
+			if err == ErrClosed {
+				return err
+			}
+			log.Print("Failed to connect to the server: ", err)
+			select {
+			case <-time.After(c.config.Retry.MaxDelay):
+				continue
+			case <-c.closed:
+				return ErrClosed
+			}
+		}
+		c.mu.Lock()
+		if slot.session != muxSession {
+			// Replaced in the meantime.
+			c.mu.Unlock()
+			go c.acceptReverseStreams(muxSession, address)
+			continue
+		}
+		handshakeResult := slot.handshakeResult
+		replaced := slot.replaced
+		c.mu.Unlock()
+		if !handshakeResult.HasFeature(common.FeatureReverse) {
+			return ErrReverseNotSupported
+		}
+
+		// If `Reconnect()` replaces the session, the server might still
+		// open streams in it until it's closed, so keep accepting them.
+		go c.acceptReverseStreams(muxSession, address)
+		select {
+		case <-muxSession.CloseChan():
+		case <-replaced:
+		case <-c.closed:
+			return ErrClosed
+		}
+	}
+}
+
+func (c *Client) acceptReverseStreams(muxSession *smux.Session, address string) {
+	for {
+		stream, err := muxSession.AcceptStream()
+		if err != nil {
+			return
+		}
+		go c.forwardReverseStream(stream, address)
+	}
+}
+
+func (c *Client) forwardReverseStream(stream *smux.Stream, address string) {
+	defer stream.Close()
+	localConn, err := net.DialTimeout("tcp", address, common.HandshakeTimeout)
+	if err != nil {
+		log.Printf("Failed to forward reverse connection (stream %v): %v", stream.ID(), err)
+		return
+	}
+	defer localConn.Close()
+	log.Printf("Forwarding reverse connection to %v (stream %v)", address, stream.ID())
+	common.CopyLoop(stream, localConn, c.closed)
+	log.Printf("Reverse connection ended (stream %v)", stream.ID())
+}
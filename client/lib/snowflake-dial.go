@@ -0,0 +1,148 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/WofWca/snowflake-generalized/common"
+	snowflakeClient "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/client/lib"
+)
+
+// What we have learned about a server that doesn't perform the handshake.
+// Such servers would pass our `Hello` to the destination, or fail,
+// so we only try the handshake until we find out that it's not supported.
+type legacyServerInfo struct {
+	isLegacy bool
+	// 0 if not found out yet.
+	smuxVersion int
+}
+
+type dialOptions struct {
+	// Must be set if the connection is going to be used alongside others,
+	// because `Transport.Dial()` closes the previous connection
+	// of the transport.
+	ownTransport bool
+	// Sent instead of `Client.hello`, if set.
+	hello *common.Hello
+}
+
+// A connection to the server on which the handshake has been performed.
+type dialedConn struct {
+	net.Conn
+	result   *common.HandshakeResult
+	endpoint Endpoint
+}
+
+// Connects through the current endpoint, or through the following ones
+// if that fails, until all of them have been tried once.
+func (c *Client) dialSnowflake(opts dialOptions) (*dialedConn, error) {
+	hello := opts.hello
+	if hello == nil {
+		hello = c.hello
+	}
+	var errs []error
+	for range c.endpoints.len() {
+		select {
+		case <-c.closed:
+			return nil, ErrClosed
+		default:
+		}
+
+		i, endpoint := c.endpoints.current()
+		var transport *snowflakeClient.Transport
+		var err error
+		if opts.ownTransport {
+			transport, err = c.endpoints.newTransport(endpoint)
+		} else {
+			transport, err = c.endpoints.sharedTransport(i)
+		}
+		if err == nil {
+			var conn net.Conn
+			var result *common.HandshakeResult
+			conn, result, err = c.dialEndpoint(endpoint, transport, hello)
+			if err == nil {
+				c.endpoints.succeeded(i)
+				return &dialedConn{conn, result, endpoint}, nil
+			}
+		}
+		log.Printf("Failed to connect to %v: %v", endpoint, err)
+		errs = append(errs, err)
+		c.endpoints.rotate(i)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Performs `Transport.Dial()` and the handshake with the server.
+// If it turns out that the server doesn't support the handshake,
+// updates `c.legacyServers` and redials, probing the smux version if needed.
+func (c *Client) dialEndpoint(
+	endpoint Endpoint,
+	transport *snowflakeClient.Transport,
+	hello *common.Hello,
+) (net.Conn, *common.HandshakeResult, error) {
+	serverKey := endpoint.serverKey()
+	snowflakeClientConn, err := c.dialTransport(transport)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.mu.Lock()
+	legacyServer := c.legacyServers[serverKey]
+	c.mu.Unlock()
+
+	if !legacyServer.isLegacy {
+		result, err := common.ClientHandshake(snowflakeClientConn, hello)
+		if err == nil {
+			common.LogHandshakeResult("server", result)
+			return snowflakeClientConn, result, nil
+		}
+		snowflakeClientConn.Close()
+		if !errors.Is(err, common.ErrNoHandshake) {
+			return nil, nil, fmt.Errorf("handshake failed: %w", err)
+		}
+
+		log.Printf(
+			"Warning: %v. The server is probably of an older version."+
+				" Will not perform the handshake from now on. Redialing",
+			err,
+		)
+		legacyServer.isLegacy = true
+		c.mu.Lock()
+		c.legacyServers[serverKey] = legacyServer
+		c.mu.Unlock()
+		snowflakeClientConn, err = c.dialTransport(transport)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if c.config.SingleConnMode {
+		// The smux version doesn't matter.
+		return snowflakeClientConn, &common.HandshakeResult{}, nil
+	}
+	if legacyServer.smuxVersion == 0 {
+		version, connStillUsable, err := common.ProbeLegacySmuxVersion(snowflakeClientConn)
+		if err != nil {
+			snowflakeClientConn.Close()
+			return nil, nil, fmt.Errorf("failed to probe the smux version: %w", err)
+		}
+		log.Printf("The server appears to use smux v%v", version)
+		legacyServer.smuxVersion = version
+		c.mu.Lock()
+		c.legacyServers[serverKey] = legacyServer
+		c.mu.Unlock()
+		if !connStillUsable {
+			snowflakeClientConn.Close()
+			log.Print("Redialing")
+			snowflakeClientConn, err = c.dialTransport(transport)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return snowflakeClientConn, &common.HandshakeResult{
+		SmuxVersion: legacyServer.smuxVersion,
+	}, nil
+}
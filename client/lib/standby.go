@@ -0,0 +1,62 @@
+package client
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Starts `Config.StandbyConnections` workers,
+// each of which keeps one standby connection.
+func (c *Client) startStandby() {
+	c.startStandbyOnce.Do(func() {
+		for range c.config.StandbyConnections {
+			go c.standbyWorker()
+		}
+	})
+}
+
+func (c *Client) standbyWorker() {
+	for {
+		// Each standby connection needs its own transport,
+		// because they all exist simultaneously.
+		dialed, err := c.connect(context.Background(), true, true)
+		if err != nil {
+			if err == ErrClosed {
+				return
+			}
+			log.Print("Failed to establish a standby connection: ", err)
+			// `MaxAttempts` got exhausted. Don't give up,
+			// but don't hammer the broker either.
+			select {
+			case <-time.After(c.config.Retry.MaxDelay):
+				continue
+			case <-c.closed:
+				return
+			}
+		}
+
+		// `c.standby` is unbuffered, so the connection is handed over
+		// only if somebody needs it right now.
+		select {
+		case c.standby <- dialed:
+		case <-c.closed:
+			dialed.Close()
+			return
+		}
+	}
+}
+
+// Returns a standby connection if one is ready.
+func (c *Client) takeStandby() (*dialedConn, bool) {
+	if c.config.StandbyConnections <= 0 {
+		return nil, false
+	}
+	select {
+	case standby := <-c.standby:
+		log.Print("Using a standby connection")
+		return standby, true
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"slices"
+)
+
+// TransparentMode is how the connections that `ForwardTransparent()`
+// accepts have been diverted to it by the firewall.
+type TransparentMode string
+
+const (
+	// The iptables / nftables REDIRECT (or DNAT) target.
+	// The original destination is taken from the conntrack entry
+	// (`SO_ORIGINAL_DST`).
+	Redirect TransparentMode = "redirect"
+	// The iptables / nftables TPROXY target.
+	// The original destination is the connection's local address.
+	// The listener must be created with `ListenTransparent()`.
+	TProxy TransparentMode = "tproxy"
+)
+
+// TransparentModes lists all the valid `TransparentMode` values.
+var TransparentModes = []TransparentMode{Redirect, TProxy}
+
+// ForwardTransparent is like `Forward()`, but for connections
+// that the firewall has diverted to `ln`: every connection goes
+// to its original destination, see `DialDestination()`.
+// This way a gateway can forward the TCP connections
+// of the whole LAN without configuring every application.
+// For UDP, see `ServeTUN()`.
+// Requires `Config.ClientDestinations`. Linux only.
+func (c *Client) ForwardTransparent(ln net.Listener, mode TransparentMode) error {
+	if !slices.Contains(TransparentModes, mode) {
+		return fmt.Errorf(
+			"unknown transparent mode %q, must be one of %v",
+			mode,
+			TransparentModes,
+		)
+	}
+	if err := checkTransparentSupported(); err != nil {
+		return err
+	}
+	return c.forward(ln, func(conn net.Conn) (net.Conn, error) {
+		destination, err := originalDestination(conn, mode)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the original destination: %w", err)
+		}
+		// Otherwise we'd forward connections to ourselves.
+		if isListenerAddress(ln, destination) {
+			return nil, fmt.Errorf(
+				"the connection to %v has not been diverted by the firewall",
+				destination,
+			)
+		}
+		return c.DialDestination("tcp", destination.String())
+	})
+}
+
+// Whether connecting to `addr` reaches `ln` without any firewall rules.
+func isListenerAddress(ln net.Listener, addr *net.TCPAddr) bool {
+	lnAddr, ok := ln.Addr().(*net.TCPAddr)
+	if !ok || lnAddr.Port != addr.Port {
+		return false
+	}
+	if !lnAddr.IP.IsUnspecified() {
+		return lnAddr.IP.Equal(addr.IP)
+	}
+	if addr.IP.IsLoopback() {
+		return true
+	}
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, ifaceAddr := range ifaceAddrs {
+		if ipNet, ok := ifaceAddr.(*net.IPNet); ok && ipNet.IP.Equal(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Not in `x/sys/unix`. See linux/netfilter_ipv6/ip6_tables.h.
+const ip6tSOOriginalDst = 80
+
+func checkTransparentSupported() error {
+	return nil
+}
+
+// ListenTransparent listens on `address` for TCP connections
+// diverted by the firewall in `mode`, see `ForwardTransparent()`.
+// `TProxy` requires `CAP_NET_ADMIN`.
+func ListenTransparent(address string, mode TransparentMode) (net.Listener, error) {
+	listenConfig := net.ListenConfig{}
+	if mode == TProxy {
+		listenConfig.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				level, opt := unix.SOL_IP, unix.IP_TRANSPARENT
+				if network == "tcp6" {
+					level, opt = unix.SOL_IPV6, unix.IPV6_TRANSPARENT
+				}
+				sockErr = unix.SetsockoptInt(int(fd), level, opt, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+	return listenConfig.Listen(context.Background(), "tcp", address)
+}
+
+func originalDestination(conn net.Conn, mode TransparentMode) (*net.TCPAddr, error) {
+	localAddr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("not a TCP connection")
+	}
+	if mode == TProxy {
+		return localAddr, nil
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("not a TCP connection")
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var destination *net.TCPAddr
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if localAddr.IP.To4() != nil {
+			// The result is a `sockaddr_in`, which fits into `IPv6Mreq`.
+			var mreq *unix.IPv6Mreq
+			mreq, sockErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+			if sockErr != nil {
+				return
+			}
+			destination = &net.TCPAddr{
+				IP:   net.IP(mreq.Multiaddr[4:8]),
+				Port: int(binary.BigEndian.Uint16(mreq.Multiaddr[2:4])),
+			}
+			return
+		}
+		// The result is a `sockaddr_in6`, which fits into `IPv6MTUInfo`.
+		var info *unix.IPv6MTUInfo
+		info, sockErr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, ip6tSOOriginalDst)
+		if sockErr != nil {
+			return
+		}
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		destination = &net.TCPAddr{
+			IP:   net.IP(info.Addr.Addr[:]),
+			Port: int(binary.BigEndian.Uint16(port[:])),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return destination, sockErr
+}
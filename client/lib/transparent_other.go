@@ -0,0 +1,23 @@
+//go:build !linux
+
+package client
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparentUnsupported = errors.New("transparent proxying is only supported on Linux")
+
+func checkTransparentSupported() error {
+	return errTransparentUnsupported
+}
+
+// ListenTransparent is only supported on Linux.
+func ListenTransparent(address string, mode TransparentMode) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
+
+func originalDestination(conn net.Conn, mode TransparentMode) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
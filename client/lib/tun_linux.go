@@ -0,0 +1,191 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/WofWca/snowflake-generalized/common"
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
+	"gvisor.dev/gvisor/pkg/tcpip/link/tun"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// How many TCP connections may be waiting for the server
+// to connect to their destinations, the rest are dropped
+// (and retried by the sender).
+const tunMaxTCPInFlight = 1024
+
+const tunNICID = 1
+
+// ServeTUN forwards all the TCP and UDP traffic that is routed
+// to the TUN interface `name` to the server, which connects
+// to the original destinations. `name` is created if it doesn't exist,
+// which requires `CAP_NET_ADMIN`. Configuring its addresses
+// and the routes through it is up to the caller, e.g.:
+//
+//	ip addr add 10.0.85.1/24 dev sfg0
+//	ip link set sfg0 up
+//	ip route add default dev sfg0
+//
+// The TCP/IP is handled by gVisor's userspace network stack.
+// Every TCP connection and UDP flow (see `Config.UDPIdleTimeout`)
+// becomes a `DialDestination()` connection, so this requires
+// `Config.ClientDestinations`. Other protocols (e.g. ICMP) are dropped.
+//
+// It returns when the client is closed.
+// Only supported on Linux.
+func (c *Client) ServeTUN(name string, mtu uint32) error {
+	if !c.config.ClientDestinations {
+		return errors.New("TUN mode requires ClientDestinations")
+	}
+	fd, err := tun.Open(name)
+	if err != nil {
+		return fmt.Errorf("failed to open TUN interface %q: %w", name, err)
+	}
+	defer unix.Close(fd)
+
+	linkEndpoint, err := fdbased.New(&fdbased.Options{FDs: []int{fd}, MTU: mtu})
+	if err != nil {
+		return err
+	}
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	defer s.Close()
+	// The handlers are not synchronized with the packets,
+	// so they must be set before the NIC starts delivering them.
+	sack := tcpip.TCPSACKEnabled(true)
+	s.SetTransportProtocolOption(tcp.ProtocolNumber, &sack)
+
+	tcpForwarder := tcp.NewForwarder(s, 0, tunMaxTCPInFlight, c.forwardTUNTCP)
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+	udpForwarder := udp.NewForwarder(s, c.forwardTUNUDP)
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+
+	if tcpipErr := s.CreateNIC(tunNICID, linkEndpoint); tcpipErr != nil {
+		return fmt.Errorf("failed to create the NIC: %v", tcpipErr)
+	}
+	// Accept packets to any address, and reply from any address.
+	s.SetPromiscuousMode(tunNICID, true)
+	s.SetSpoofing(tunNICID, true)
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: tunNICID},
+		{Destination: header.IPv6EmptySubnet, NIC: tunNICID},
+	})
+
+	log.Printf("Forwarding the traffic of TUN interface %v", name)
+	<-c.closed
+	return ErrClosed
+}
+
+func tunDestination(id stack.TransportEndpointID) string {
+	return net.JoinHostPort(id.LocalAddress.String(), strconv.Itoa(int(id.LocalPort)))
+}
+
+// Called in a new goroutine for every new TCP connection.
+// The TCP handshake is only completed after the server has connected
+// to the destination, so that the application sees
+// an unreachable destination as such.
+func (c *Client) forwardTUNTCP(r *tcp.ForwarderRequest) {
+	destination := tunDestination(r.ID())
+	snowflakeConn, err := c.DialDestination("tcp", destination)
+	if err != nil {
+		log.Printf("Failed to forward TCP connection to %v: %v", destination, err)
+		r.Complete(true)
+		return
+	}
+	defer snowflakeConn.Close()
+
+	var wq waiter.Queue
+	ep, tcpipErr := r.CreateEndpoint(&wq)
+	if tcpipErr != nil {
+		log.Printf("Failed to accept TCP connection to %v: %v", destination, tcpipErr)
+		r.Complete(true)
+		return
+	}
+	r.Complete(false)
+	localConn := gonet.NewTCPConn(&wq, ep)
+	defer localConn.Close()
+
+	common.CopyLoop(snowflakeConn, localConn, c.closed)
+}
+
+// Called for every new UDP flow, i.e. a datagram
+// from a new source to a new destination.
+func (c *Client) forwardTUNUDP(r *udp.ForwarderRequest) {
+	destination := tunDestination(r.ID())
+	var wq waiter.Queue
+	ep, tcpipErr := r.CreateEndpoint(&wq)
+	if tcpipErr != nil {
+		log.Printf("Failed to accept UDP flow to %v: %v", destination, tcpipErr)
+		return
+	}
+	localConn := gonet.NewUDPConn(&wq, ep)
+
+	go func() {
+		defer localConn.Close()
+		// The datagrams that arrive in the meantime wait
+		// in the endpoint's receive buffer.
+		snowflakeConn, err := c.DialDestination("udp", destination)
+		if err != nil {
+			log.Printf("Failed to forward UDP flow to %v: %v", destination, err)
+			return
+		}
+		defer snowflakeConn.Close()
+
+		idleTimeout := c.config.UDPIdleTimeout
+		if idleTimeout <= 0 {
+			idleTimeout = defaultUDPIdleTimeout
+		}
+		var closeOnce sync.Once
+		closeBoth := func() {
+			closeOnce.Do(func() {
+				snowflakeConn.Close()
+				localConn.Close()
+			})
+		}
+		idleTimer := time.AfterFunc(idleTimeout, closeBoth)
+		defer idleTimer.Stop()
+		stopClosing := make(chan struct{})
+		defer close(stopClosing)
+		go func() {
+			select {
+			case <-c.closed:
+				closeBoth()
+			case <-stopClosing:
+			}
+		}()
+
+		copyDatagrams := func(dst net.Conn, src net.Conn) {
+			defer closeBoth()
+			buf := make([]byte, common.MaxDatagramSize)
+			for {
+				n, err := src.Read(buf)
+				if err != nil {
+					return
+				}
+				idleTimer.Reset(idleTimeout)
+				if _, err := dst.Write(buf[:n]); err != nil {
+					return
+				}
+			}
+		}
+		go copyDatagrams(snowflakeConn, localConn)
+		copyDatagrams(localConn, snowflakeConn)
+	}()
+}
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	snowflakeServer "github.com/WofWca/snowflake-generalized/server/lib"
+)
+
+// Set when the test runs in its own network namespace.
+const tunTestNetnsEnv = "SFG_TUN_TEST_NETNS"
+
+// Pushes TCP and UDP through a TUN interface, the client,
+// and a server that "connects" to in-memory destinations.
+// It needs root, so it runs itself in a new network namespace,
+// so that the interface and the routes don't affect the host.
+func TestTUN(t *testing.T) {
+	if os.Getenv(tunTestNetnsEnv) == "" {
+		if os.Geteuid() != 0 {
+			t.Skip("needs root")
+		}
+		if _, err := os.Stat("/dev/net/tun"); err != nil {
+			t.Skip("needs /dev/net/tun")
+		}
+		for _, tool := range []string{"unshare", "ip"} {
+			if _, err := exec.LookPath(tool); err != nil {
+				t.Skipf("needs %v", tool)
+			}
+		}
+		cmd := exec.Command("unshare", "--net", os.Args[0], "-test.run=^TestTUN$", "-test.v")
+		cmd.Env = append(os.Environ(), tunTestNetnsEnv+"=1")
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v\n%s", err, output)
+		}
+		t.Logf("%s", output)
+		return
+	}
+
+	const (
+		iface       = "sfgtest0"
+		destination = "10.0.86.2:7"
+	)
+
+	dialer := snowflakeServer.NewMemoryDialer()
+	acl, err := snowflakeServer.ParseACL(bytes.NewBufferString("allow any 10.0.86.0/24\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, network := range []string{"tcp", "udp"} {
+		ln, err := dialer.Listen(network, destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go serveEcho(ln)
+	}
+
+	client := newTestClient(
+		t,
+		snowflakeServer.Config{
+			DestinationProtocol:     "tcp",
+			Dialer:                  dialer,
+			AllowClientDestinations: true,
+			DestinationACL:          acl,
+		},
+		Config{
+			DestinationProtocol: "tcp",
+			ClientDestinations:  true,
+		},
+	)
+	go client.ServeTUN(iface, 1500)
+
+	waitForInterface(t, iface)
+	for _, args := range [][]string{
+		{"link", "set", "lo", "up"},
+		{"addr", "add", "10.0.85.1/24", "dev", iface},
+		{"link", "set", iface, "up"},
+		{"route", "add", "10.0.86.0/24", "dev", iface},
+	} {
+		if output, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			t.Fatalf("ip %v: %v\n%s", args, err, output)
+		}
+	}
+
+	for _, network := range []string{"tcp", "udp"} {
+		t.Run(network, func(t *testing.T) {
+			conn, err := net.DialTimeout(network, destination, 10*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			message := []byte("hello through " + network)
+			if _, err := conn.Write(message); err != nil {
+				t.Fatal(err)
+			}
+			reply := make([]byte, len(message))
+			if _, err := io.ReadFull(conn, reply); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(reply, message) {
+				t.Fatalf("got %q, want %q", reply, message)
+			}
+			remote := netip.MustParseAddrPort(conn.RemoteAddr().String())
+			if remote.String() != destination {
+				t.Errorf("connected to %v, want %v", remote, destination)
+			}
+		})
+	}
+}
+
+func waitForInterface(t *testing.T, name string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := net.InterfaceByName(name); err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("interface %v hasn't appeared", name)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package client
+
+import "errors"
+
+// ServeTUN is only supported on Linux.
+func (c *Client) ServeTUN(name string, mtu uint32) error {
+	return errors.New("TUN mode is only supported on Linux")
+}
@@ -0,0 +1,211 @@
+package client
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/WofWca/snowflake-generalized/common"
+)
+
+// The default `Config.UDPIdleTimeout`.
+// Similar to what NATs and Linux conntrack use for UDP.
+const defaultUDPIdleTimeout = 3 * time.Minute
+
+// How many datagrams from a peer may wait for its connection
+// to the server to get established. The rest are dropped.
+const udpAssociationQueueSize = 64
+
+// A local UDP peer of `ForwardUDP()`, with its own connection
+// to the server's destination.
+type udpAssociation struct {
+	peer    net.Addr
+	packets chan []byte
+	// Unix nanoseconds.
+	lastActive atomic.Int64
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (a *udpAssociation) touch() {
+	a.lastActive.Store(time.Now().UnixNano())
+}
+
+func (a *udpAssociation) idleFor() time.Duration {
+	return time.Since(time.Unix(0, a.lastActive.Load()))
+}
+
+func (a *udpAssociation) close() {
+	a.closeOnce.Do(func() { close(a.closed) })
+}
+
+// ForwardUDP is like `Forward()`, but for a UDP socket:
+// the datagrams of every local peer (source address)
+// go through a separate connection returned by `Dial()`,
+// and the replies are sent back to that peer.
+// This way several local UDP applications can share one socket.
+//
+// A peer's association is removed after `Config.UDPIdleTimeout`
+// without datagrams in either direction.
+// When there are already `Config.MaxConnections` associations,
+// the least recently active one is removed to make room for a new peer.
+// `pconn` is not closed.
+func (c *Client) ForwardUDP(pconn net.PacketConn) error {
+	idleTimeout := c.config.UDPIdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultUDPIdleTimeout
+	}
+
+	var mu sync.Mutex
+	associations := make(map[string]*udpAssociation)
+	remove := func(a *udpAssociation) {
+		mu.Lock()
+		defer mu.Unlock()
+		if associations[a.peer.String()] == a {
+			delete(associations, a.peer.String())
+		}
+		a.close()
+	}
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, a := range associations {
+			a.close()
+		}
+	}()
+
+	janitorDone := make(chan struct{})
+	defer close(janitorDone)
+	go func() {
+		ticker := time.NewTicker(idleTimeout / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-janitorDone:
+				return
+			}
+			mu.Lock()
+			for key, a := range associations {
+				if a.idleFor() >= idleTimeout {
+					log.Printf("UDP peer %v has been idle for %v, forgetting it", a.peer, idleTimeout)
+					delete(associations, key)
+					a.close()
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+
+	buf := make([]byte, common.MaxDatagramSize)
+	for {
+		n, peer, err := pconn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-c.closed:
+				return ErrClosed
+			default:
+			}
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				continue
+			}
+			log.Print("Failed to read from the UDP socket", err)
+			return err
+		}
+
+		mu.Lock()
+		a, ok := associations[peer.String()]
+		if !ok {
+			maxAssociations := c.config.MaxConnections
+			if maxAssociations > 0 && len(associations) >= maxAssociations {
+				var oldest *udpAssociation
+				for _, other := range associations {
+					if oldest == nil || other.lastActive.Load() < oldest.lastActive.Load() {
+						oldest = other
+					}
+				}
+				log.Printf(
+					"Too many UDP peers (%v), forgetting the least recently active one, %v",
+					len(associations),
+					oldest.peer,
+				)
+				delete(associations, oldest.peer.String())
+				oldest.close()
+			}
+			a = &udpAssociation{
+				peer:    peer,
+				packets: make(chan []byte, udpAssociationQueueSize),
+				closed:  make(chan struct{}),
+			}
+			a.touch()
+			associations[peer.String()] = a
+			log.Printf("Got new UDP peer %v! Forwarding", peer)
+			go func() {
+				defer remove(a)
+				c.serveUDPAssociation(pconn, a)
+			}()
+		}
+		mu.Unlock()
+
+		a.touch()
+		select {
+		case a.packets <- append([]byte(nil), buf[:n]...):
+		default:
+			// Still connecting, or the connection can't keep up.
+		}
+	}
+}
+
+func (c *Client) serveUDPAssociation(pconn net.PacketConn, a *udpAssociation) {
+	// In single-connection mode this establishes a whole new
+	// Snowflake connection, which might take a while.
+	snowflakeConn, err := c.Dial()
+	if err != nil {
+		log.Printf("Failed to forward UDP peer %v: %v", a.peer, err)
+		return
+	}
+	defer snowflakeConn.Close()
+
+	stopClosing := make(chan struct{})
+	defer close(stopClosing)
+	go func() {
+		select {
+		case <-a.closed:
+			snowflakeConn.Close()
+		case <-c.closed:
+			snowflakeConn.Close()
+		case <-stopClosing:
+		}
+	}()
+
+	go func() {
+		defer a.close()
+		buf := make([]byte, common.MaxDatagramSize)
+		for {
+			n, err := snowflakeConn.Read(buf)
+			if err != nil {
+				return
+			}
+			a.touch()
+			if _, err := pconn.WriteTo(buf[:n], a.peer); err != nil {
+				log.Printf("Failed to send a datagram to UDP peer %v: %v", a.peer, err)
+			}
+		}
+	}()
+
+	for {
+		select {
+		case packet := <-a.packets:
+			if _, err := snowflakeConn.Write(packet); err != nil {
+				log.Printf("Connection ended for UDP peer %v: %v", a.peer, err)
+				return
+			}
+		case <-a.closed:
+			log.Printf("Connection ended for UDP peer %v", a.peer)
+			return
+		}
+	}
+}
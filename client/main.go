@@ -1,16 +1,21 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	sfgClient "github.com/WofWca/snowflake-generalized/client/lib"
 	"github.com/WofWca/snowflake-generalized/common"
-	pionUDP "github.com/pion/transport/v3/udp"
-	"github.com/xtaci/smux"
 	safelog "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/ptutil/safelog"
 	snowflakeClient "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/client/lib"
 )
@@ -21,17 +26,46 @@ func main() {
 	// - https://gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/-/blob/97e21e3a29f8dd8306ed893a8341ce91846b02f7/client/snowflake.go#L80-128
 
 	// TODO maybe spin up a public broker?
-	brokerURL := flag.String("broker-url", "", "URL of signaling broker")
+	brokerURL := flag.String(
+		"broker-url",
+		"",
+		"URL of signaling broker."+
+			"\nCan be a comma-separated list, see \"shuffle-endpoints\"",
+	)
 	serverId := flag.String(
 		"server-id",
 		"",
 		"40 hex character server ID to which to forward the connections."+
-			"See also \"server-url\".",
+			"See also \"server-url\"."+
+			"\nCan be a comma-separated list, see \"shuffle-endpoints\"",
 	)
 	serverUrl := flag.String(
 		"server-url",
 		"",
-		"Server `URL` to which to forward the connections",
+		"Server `URL` to which to forward the connections."+
+			"\nCan be a comma-separated list, see \"shuffle-endpoints\"",
+	)
+	token := flag.String(
+		"token",
+		"",
+		"The `token` that identifies the client to the server,"+
+			" if the server has \"users\"."+
+			"\nSnowflake proxies can see it, so it's not much of a secret",
+	)
+	shuffleEndpoints := flag.Bool(
+		"shuffle-endpoints",
+		false,
+		"If several servers or brokers are specified, every server"+
+			" is tried with every broker, in the specified order,"+
+			" moving on to the next combination when connecting fails"+
+			" or the connection keeps getting lost."+
+			"\nThis flag randomizes the order",
+	)
+	stateFile := flag.String(
+		"state-file",
+		"",
+		"`path` to the file where to remember the server and the broker"+
+			" that worked last, so that they're tried first after a restart",
 	)
 
 	listenAddr := flag.String(
@@ -56,6 +90,9 @@ func main() {
 	// unreliable and unordered. When
 	// https://gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/-/issues/40352
 	// is done.
+	// This is still to be done. For now in UDP mode we only drop
+	// the datagrams that the connection can't keep up with,
+	// see `common.FeatureDatagramFraming`.
 	singleConnMode := flag.Bool(
 		"single-connection-mode",
 		false,
@@ -65,16 +102,218 @@ func main() {
 			" or an OpenVPN server), you can toggle this flag on."+
 			"\nIt turns off multiplexing, and thus it _might_"+
 			" improve connection performance."+
+			" Every connection then gets its own Snowflake proxy,"+
+			" see also \"max-connections\"."+
 			"\nThe value of this flag must be the same for both"+
 			" the server and the client.",
 	)
 
+	maxConnections := flag.Int(
+		"max-connections",
+		0,
+		"How many application connections to forward at the same time,"+
+			" the rest have to wait. 0 means no limit."+
+			"\nFor UDP this is how many local peers (source addresses)"+
+			" to forward for; when there are more, the least recently"+
+			" active one is forgotten",
+	)
+	udpIdleTimeout := flag.Duration(
+		"udp-idle-timeout",
+		3*time.Minute,
+		"For UDP, stop forwarding for a local peer (source address)"+
+			" after it has been idle for this `duration`",
+	)
+
+	sessions := flag.Int(
+		"sessions",
+		1,
+		"How many Snowflake connections to use simultaneously,"+
+			" each through a different proxy, to not be limited"+
+			" by the bandwidth of a single proxy."+
+			" Application connections are distributed between them."+
+			" Has no effect in single-connection mode",
+	)
+	stripingStrategy := flag.String(
+		"striping-strategy",
+		string(sfgClient.LeastStreams),
+		fmt.Sprintf(
+			"How to pick one of the \"sessions\" for a new connection, one of %v",
+			sfgClient.StripingStrategies,
+		),
+	)
+
+	paths := flag.Int(
+		"paths",
+		1,
+		"If greater than 1, every connection to the server is made of"+
+			" this many Snowflake connections through different proxies,"+
+			" and the data is split between them."+
+			" This way even a single big download is not limited"+
+			" by one proxy's bandwidth, and losing a proxy doesn't"+
+			" break the connection."+
+			"\nRequires a server that supports it",
+	)
+
+	resumable := flag.Bool(
+		"resumable",
+		false,
+		"Keep the connection to the destination alive when"+
+			" the Snowflake proxy is lost: reconnect through a new one,"+
+			" and resend the data that might have been lost."+
+			" Useful in single-connection mode,"+
+			" e.g. so that a WireGuard flow isn't reset."+
+			"\nImplied by \"paths\" > 1. Requires a server that supports it",
+	)
+
+	standbyConnections := flag.Int(
+		"standby-connections",
+		0,
+		"How many extra connections to the server to keep established,"+
+			" so that they can be used right away when the current one"+
+			" is lost, or, in single-connection mode,"+
+			" when a new application connection arrives."+
+			"\nEach of them occupies a Snowflake proxy",
+	)
+
 	serverIsOldVersion := flag.Bool(
 		"server-is-old-version",
 		false,
-		"Prior to 2025-01-13, we used smux version 1 instead of the latest 2."+
-			" If the server is of that older version, use this flag."+
-			"\nThis flag has no effect when using single-connection-mode",
+		"Deprecated: the smux version is now negotiated with the server,"+
+			" or detected automatically for servers that don't support"+
+			" the negotiation."+
+			"\nPrior to 2025-01-13, we used smux version 1 instead of the latest 2."+
+			" If the server is of that older version, this flag"+
+			" skips the detection."+
+			" In single-connection mode it also avoids waiting"+
+			" for the server's response to the negotiation"+
+			" for 30 seconds after every restart.",
+	)
+
+	retryInitialDelay := flag.Duration(
+		"retry-initial-delay",
+		time.Second,
+		"If connecting to the server fails, retry after this `duration`."+
+			"\nThe delay doubles with every failed attempt and is randomized",
+	)
+	retryMaxDelay := flag.Duration(
+		"retry-max-delay",
+		time.Minute,
+		"The maximum `duration` between attempts to connect to the server",
+	)
+	retryMaxAttempts := flag.Int(
+		"retry-max-attempts",
+		0,
+		"How many times to try to connect to the server in a row"+
+			" before giving up, 0 means infinite."+
+			"\nThe client keeps running even after giving up,"+
+			" and tries again when a new connection arrives",
+	)
+	failFast := flag.Bool(
+		"fail-fast",
+		false,
+		"Close application connections right away if there is"+
+			" no connection to the server at the moment,"+
+			" instead of making them wait until it's (re-)established",
+	)
+
+	onDemand := flag.Bool(
+		"on-demand",
+		false,
+		"Only connect to the server when the first application connection"+
+			" arrives, and disconnect after \"idle-timeout\""+
+			" without connections."+
+			"\nThis saves volunteers' proxy capacity."+
+			" Has no effect in single-connection mode",
+	)
+	idleTimeout := flag.Duration(
+		"idle-timeout",
+		5*time.Minute,
+		"With \"on-demand\", disconnect from the server after"+
+			" there have been no application connections"+
+			" for this `duration`",
+	)
+
+	tunName := flag.String(
+		"tun",
+		"",
+		"Instead of listening on \"listen-address\", forward all the TCP"+
+			" and UDP traffic routed to the TUN `interface` with this name,"+
+			" to wherever it is destined (Linux only)."+
+			" The interface is created if it doesn't exist."+
+			" Assigning it an address and routing traffic through it"+
+			" is up to you, e.g. \"ip addr add 10.0.85.1/24 dev sfg0 &&"+
+			" ip link set sfg0 up && ip route add default dev sfg0\"."+
+			"\nThe server must have \"allow-client-destinations\"."+
+			" Not supported in single-connection mode",
+	)
+	tunMTU := flag.Uint(
+		"tun-mtu",
+		1500,
+		"The MTU of the \"tun\" interface",
+	)
+
+	transparentMode := flag.String(
+		"transparent",
+		"",
+		fmt.Sprintf(
+			"Accept TCP connections on \"listen-address\" that the firewall"+
+				" has diverted, and forward each one to its original destination,"+
+				" e.g. to tunnel a whole LAN through a gateway (Linux only)."+
+				" One of %v: %q is for the iptables / nftables REDIRECT target,"+
+				" %q is for TPROXY (requires CAP_NET_ADMIN)."+
+				"\nThe server must have \"allow-client-destinations\"."+
+				" Not supported in single-connection mode",
+			sfgClient.TransparentModes,
+			sfgClient.Redirect,
+			sfgClient.TProxy,
+		),
+	)
+
+	dnsListenAddr := flag.String(
+		"dns-listen-address",
+		"",
+		"Also answer DNS queries (UDP and TCP) on this `address`,"+
+			" e.g. \"127.0.0.1:53\", by forwarding them to the resolver"+
+			" of the server (see its \"dns-resolver\"),"+
+			" so that they don't leak locally. The responses are cached."+
+			"\nNot supported in single-connection mode",
+	)
+
+	reverseAddr := flag.String(
+		"reverse-address",
+		"",
+		"Also forward the connections that the server accepts"+
+			" on its \"reverse-listen-address\" to this local TCP `address`"+
+			" (like \"ssh -R\")."+
+			"\nNot supported in single-connection mode or with \"on-demand\"",
+	)
+
+	controlSocket := flag.String(
+		"control-socket",
+		"",
+		"Serve the control HTTP API on a Unix socket at this `path`,"+
+			" to see the status, reconnect through new proxies,"+
+			" switch servers and brokers, add and remove port forwards"+
+			" and turn the logs off and on, without restarting."+
+			" See the README for the API."+
+			"\nOnly the owner can access the socket",
+	)
+
+	socketMark := flag.Uint(
+		"socket-mark",
+		0,
+		"Set this `mark` (SO_MARK) on the connections to the broker,"+
+			" STUN servers and Snowflake proxies, so that they can bypass"+
+			" a full-tunnel VPN (e.g. \"tun\") with policy routing,"+
+			" e.g. \"ip rule add fwmark 0x5f lookup main priority 100\"."+
+			"\nLinux only, requires CAP_NET_ADMIN",
+	)
+	bindInterface := flag.String(
+		"bind-interface",
+		"",
+		"Make the connections to the broker, STUN servers and Snowflake"+
+			" proxies through this network `interface` (SO_BINDTODEVICE),"+
+			" e.g. to bypass a full-tunnel VPN. Linux only",
 	)
 
 	iceServersCommas := flag.String(
@@ -106,9 +345,14 @@ func main() {
 	unsafeLogging := flag.Bool("unsafe-logging", false, "prevent logs from being scrubbed")
 	max := flag.Int("max", 1,
 		"capacity for number of multiplexed WebRTC peers")
-	// versionFlag := flag.Bool("version", false, "display version info to stderr and quit")
+	versionFlag := flag.Bool("version", false, "display version info to stderr and quit")
 	flag.Parse()
 
+	if *versionFlag {
+		fmt.Fprint(os.Stderr, common.GetBuildInfo().String())
+		os.Exit(0)
+	}
+
 	if *brokerURL == "" {
 		flag.Usage()
 		log.Fatal("\"broker-url\" must be specified because the default broker only supports Tor relays.\nSee https://gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/-/issues/40166")
@@ -123,37 +367,77 @@ func main() {
 	}
 
 	var listener net.Listener
-	switch *destinationProtocol {
-	case "tcp":
-		listenAddrStruct, err := net.ResolveTCPAddr("tcp", *listenAddr)
-		if err != nil {
-			log.Fatal(err)
+	var udpListener net.PacketConn
+	if *tunName != "" {
+		if *singleConnMode {
+			log.Fatal("\"tun\" is not supported in single-connection mode")
+		}
+	} else if *transparentMode != "" {
+		if *singleConnMode {
+			log.Fatal("\"transparent\" is not supported in single-connection mode")
 		}
-		listener, err = net.ListenTCP("tcp", listenAddrStruct)
+		var err error
+		listener, err = sfgClient.ListenTransparent(
+			*listenAddr,
+			sfgClient.TransparentMode(*transparentMode),
+		)
 		if err != nil {
-			log.Fatalf(
-				"Failed to listen on \"%v\" %v: %v",
-				*listenAddr,
-				destinationProtocol,
-				err,
-			)
+			log.Fatalf("Failed to listen on \"%v\": %v", *listenAddr, err)
+		}
+	} else {
+		switch *destinationProtocol {
+		case "tcp":
+			listenAddrStruct, err := net.ResolveTCPAddr("tcp", *listenAddr)
+			if err != nil {
+				log.Fatal(err)
+			}
+			listener, err = net.ListenTCP("tcp", listenAddrStruct)
+			if err != nil {
+				log.Fatalf(
+					"Failed to listen on \"%v\" %v: %v",
+					*listenAddr,
+					destinationProtocol,
+					err,
+				)
+			}
+		case "udp":
+			listenAddrStruct, err := net.ResolveUDPAddr("udp", *listenAddr)
+			if err != nil {
+				log.Fatal(err)
+			}
+			udpListener, err = net.ListenUDP("udp", listenAddrStruct)
+			if err != nil {
+				log.Fatalf(
+					"Failed to listen on \"%v\" %v: %v",
+					*listenAddr,
+					destinationProtocol,
+					err,
+				)
+			}
+		default:
+			log.Fatal("`destination-protocol` parameter value must either be \"tcp\" or \"udp\"")
+		}
+	}
+
+	var dnsListener net.Listener
+	var dnsUDPListener net.PacketConn
+	if *dnsListenAddr != "" {
+		if *singleConnMode {
+			log.Fatal("\"dns-listen-address\" is not supported in single-connection mode")
 		}
-	case "udp":
-		listenAddrStruct, err := net.ResolveUDPAddr("udp", *listenAddr)
+		var err error
+		dnsUDPListener, err = net.ListenPacket("udp", *dnsListenAddr)
 		if err != nil {
-			log.Fatal(err)
+			log.Fatalf("Failed to listen on \"%v\" udp: %v", *dnsListenAddr, err)
 		}
-		listener, err = pionUDP.Listen("udp", listenAddrStruct)
+		dnsListener, err = net.Listen("tcp", *dnsListenAddr)
 		if err != nil {
-			log.Fatalf(
-				"Failed to listen on \"%v\" %v: %v",
-				*listenAddr,
-				destinationProtocol,
-				err,
-			)
+			log.Fatalf("Failed to listen on \"%v\" tcp: %v", *dnsListenAddr, err)
 		}
-	default:
-		log.Fatal("`destination-protocol` parameter value must either be \"tcp\" or \"udp\"")
+	}
+
+	if *reverseAddr != "" && (*singleConnMode || *onDemand) {
+		log.Fatal("\"reverse-address\" is not supported in single-connection mode or with \"on-demand\"")
 	}
 
 	var frontDomains []string
@@ -163,205 +447,220 @@ func main() {
 
 	// Setting scrubber _after_ initial checks
 	// so that addresses are printed properly.
-	logOutput := os.Stdout
+	logOutput := &switchableWriter{Writer: os.Stdout}
 	if *unsafeLogging {
 		log.SetOutput(logOutput)
 	} else {
 		log.SetOutput(&safelog.LogScrubber{Output: logOutput})
 	}
 
-	config := snowflakeClient.ClientConfig{
-		BrokerURL:         *brokerURL,
-		BridgeFingerprint: *serverId,
-		RelayURL:          *serverUrl,
-
-		FrontDomains: frontDomains,
-		AmpCacheURL:  *ampCacheURL,
-		SQSQueueURL:  *sqsQueueURL,
-		SQSCredsStr:  *sqsCredsStr,
+	var endpoints []sfgClient.Endpoint
+	for _, server := range splitCommas(*serverUrl + *serverId) {
+		for _, broker := range splitCommas(*brokerURL) {
+			endpoint := sfgClient.Endpoint{BrokerURL: broker}
+			if *serverUrl != "" {
+				endpoint.RelayURL = server
+			} else {
+				endpoint.BridgeFingerprint = server
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+	}
 
-		ICEAddresses:       strings.Split(strings.TrimSpace(*iceServersCommas), ","),
-		KeepLocalAddresses: *keepLocalAddresses,
-		Max:                *max,
+	log.Printf("Snowflake Generalized client version %v", common.GetBuildInfo().ShortString())
+	if *tunName != "" {
+		log.Printf("Forwarding TUN interface %v traffic to one of %v", *tunName, endpoints)
+	} else if len(endpoints) == 1 {
+		log.Printf(
+			"Forwarding %v connections to \"%v\" to %v",
+			*destinationProtocol,
+			*listenAddr,
+			endpoints[0],
+		)
+	} else {
+		log.Printf(
+			"Forwarding %v connections to \"%v\" to one of %v",
+			*destinationProtocol,
+			*listenAddr,
+			endpoints,
+		)
+	}
 
-		UTLSRemoveSNI: *utlsNoSni,
-		UTLSClientID:  *utlsImitate,
+	var idleTimeoutIfOnDemand time.Duration
+	if *onDemand {
+		idleTimeoutIfOnDemand = *idleTimeout
+	}
+	config := sfgClient.Config{
+		Snowflake: snowflakeClient.ClientConfig{
+			FrontDomains: frontDomains,
+			AmpCacheURL:  *ampCacheURL,
+			SQSQueueURL:  *sqsQueueURL,
+			SQSCredsStr:  *sqsCredsStr,
+
+			ICEAddresses:       strings.Split(strings.TrimSpace(*iceServersCommas), ","),
+			KeepLocalAddresses: *keepLocalAddresses,
+			Max:                *max,
+
+			UTLSRemoveSNI: *utlsNoSni,
+			UTLSClientID:  *utlsImitate,
+		},
+		Endpoints:        endpoints,
+		ShuffleEndpoints: *shuffleEndpoints,
+		StateFile:        *stateFile,
+		Token:            *token,
+		Retry: sfgClient.RetryPolicy{
+			InitialDelay: *retryInitialDelay,
+			MaxDelay:     *retryMaxDelay,
+			MaxAttempts:  *retryMaxAttempts,
+		},
+		FailFast:            *failFast,
+		IdleTimeout:         idleTimeoutIfOnDemand,
+		DestinationProtocol: *destinationProtocol,
+		SingleConnMode:      *singleConnMode,
+		MaxConnections:      *maxConnections,
+		UDPIdleTimeout:      *udpIdleTimeout,
+		ClientDestinations:  *tunName != "" || *transparentMode != "",
+		DNS:                 *dnsListenAddr != "",
+		Reverse:             *reverseAddr != "",
+		SocketMark:          uint32(*socketMark),
+		BindInterface:       *bindInterface,
+		StandbyConnections:  *standbyConnections,
+		Sessions:            *sessions,
+		Paths:               *paths,
+		Resumable:           *resumable,
+		StripingStrategy:    sfgClient.StripingStrategy(*stripingStrategy),
+		ServerIsOldVersion:  *serverIsOldVersion,
 	}
-	snowflakeClientTransport, err := snowflakeClient.NewSnowflakeClient(config)
+	client, err := sfgClient.NewClient(config)
 	if err != nil {
 		log.Fatal("Failed to start snowflake transport: ", err)
 	}
+	defer client.Close()
 
-	var idOrUrlString string
-	if *serverUrl != "" {
-		idOrUrlString = *serverUrl
-	} else {
-		idOrUrlString = fmt.Sprintf("with ID %v", serverId)
-	}
-	log.Printf(
-		"Forwarding %v connections to \"%v\" to server %v",
-		*destinationProtocol,
-		*listenAddr,
-		idOrUrlString,
-	)
-
-	if *singleConnMode {
-		for {
-			err := serveOneConnInSingleConnMode(listener, snowflakeClientTransport)
-			if err != nil {
-				return
+	if !*onDemand {
+		// Don't wait for the connection to the server.
+		// The application connections that arrive in the meantime
+		// wait for it in `Dial()`.
+		go func() {
+			if err := client.Start(context.Background()); err != nil {
+				log.Print("Failed to connect to the server: ", err)
 			}
-		}
-	} else {
-		snowflakeClientConn, err := snowflakeClientTransport.Dial()
+		}()
+	}
+	if *controlSocket != "" {
+		controlListener, err := listenControlSocket(*controlSocket)
 		if err != nil {
-			// TODO should we retry?
-			log.Fatal("Snowflake dial failed", err)
+			log.Fatalf("Failed to listen on \"%v\": %v", *controlSocket, err)
 		}
-
-		// Why use a multiplexer instead of `snowflakeClientTransport.Dial()`-ing
-		// per each TCP connection?
-		// Firstly, connecting to a new proxy takes some seconds
-		// (sometimes minutes!).
-		// This is not great if we expect to receive connections frequently.
-		// E.g. for the case of SOCKS proxy. A browser SOCKS client
-		// makes a new TCP connection per nearly every HTTP request,
-		// so each request would be delayed by the amount of time
-		// it takes to get a new Snowflake proxy.
-		//
-		// Secondly, apparently the previous `Dial()` gets discarded
-		// and connection lost.
-		//
-		// https://github.com/xtaci/smux?tab=readme-ov-file#usage
-		//
-		// TODO perf: Snowflake already uses smux internally.
-		// Can we maybe modify the library so that it exposes the session
-		// so we can use it?
-		// https://gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/-/blob/bf116939935b0a2ae2adf4f5976c349aae96e48b/client/lib/snowflake.go#L211-212
-
-		smuxConfig := smux.DefaultConfig()
-		if *serverIsOldVersion {
-			smuxConfig.Version = 1
-		} else {
-			// This seems to ~double TCP connection speed, as of 2025-01-13.
-			// Or so did it look based on a single test.
-			smuxConfig.Version = 2
+		defer controlListener.Close()
+		log.Printf("Serving the control API on \"%v\"", *controlSocket)
+		controlHandler := client.ControlHandler(sfgClient.ControlConfig{
+			SetLogging: logOutput.setEnabled,
+		})
+		go http.Serve(controlListener, controlHandler)
+	}
+	if *dnsListenAddr != "" {
+		log.Printf("Forwarding DNS queries to \"%v\" to the server's resolver", *dnsListenAddr)
+		go client.ServeDNS(dnsUDPListener)
+		go client.ServeDNSTCP(dnsListener)
+	}
+	if *reverseAddr != "" {
+		log.Printf("Forwarding the server's reverse connections to \"%v\"", *reverseAddr)
+		go func() {
+			err := client.ServeReverse(*reverseAddr)
+			if err == sfgClient.ErrReverseNotSupported {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if *tunName != "" {
+		if err := client.ServeTUN(*tunName, uint32(*tunMTU)); err != nil {
+			log.Fatal(err)
 		}
-		// Connecting with Snowflake might take some minutes sometimes.
-		// Let's not close the connection on our own, and let Snowflake handle that.
-		//
-		// TODO we probably don't want to terminate the client at all and
-		// just keep retrying.
-		smuxConfig.KeepAliveDisabled = true
-		// This seems to increase download speed by about x2,
-		// at least for the SOCKS example, based on eyeball tests.
-		// See https://gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/-/merge_requests/48
-		smuxConfig.MaxStreamBuffer = snowflakeClient.StreamSize
-
-		snowflakeClientMuxSession, err := smux.Client(snowflakeClientConn, smuxConfig)
+	} else if *transparentMode != "" {
+		err := client.ForwardTransparent(
+			listener,
+			sfgClient.TransparentMode(*transparentMode),
+		)
 		if err != nil {
 			log.Fatal(err)
 		}
-
-		muxModeAcceptLoop(listener, snowflakeClientMuxSession)
+	} else if udpListener != nil {
+		client.ForwardUDP(udpListener)
+	} else {
+		client.Forward(listener)
 	}
 }
 
-func muxModeAcceptLoop(
-	ln net.Listener,
-	snowflakeClientMuxSession *smux.Session,
-) {
-	for {
-		netConn, err := ln.Accept()
-		if err != nil {
-			if err, ok := err.(net.Error); ok && err.Temporary() {
-				continue
-			}
-			log.Print("Failed to accept connection", err)
-			// TODO is this what we want? This will terminate the client.
-			break
+// Splits a comma-separated list, ignoring spaces and empty items.
+func splitCommas(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
 		}
-		log.Printf(
-			"Got new connection from %v! Forwarding",
-			netConn.RemoteAddr().String(),
-		)
-
-		go func() {
-			defer netConn.Close()
-			// TODO handle errors carefully.
-			// E.g. there is `ErrGoAway` which occurs when stream IDs
-			// get exhausted, and when that happens,
-			// we can never open a new stream, which means that
-			// we probably need to recreate a smux session.
-			snowflakeStream, err := snowflakeClientMuxSession.OpenStream()
-			if err != nil {
-				log.Print("smux.OpenStream() failed: ", err)
-				return
-			}
-			defer snowflakeStream.Close()
-
-			// TODO should we utilize `shutdownChan`?
-			shutdownChan := make(chan struct{})
-			common.CopyLoop(snowflakeStream, netConn, shutdownChan)
-			log.Printf(
-				"Connection ended %v (stream %v)",
-				netConn.RemoteAddr().String(),
-				snowflakeStream.ID(),
-			)
-		}()
 	}
+	return items
 }
 
-// If an error is returned, this function should not be called another time.
-func serveOneConnInSingleConnMode(
-	ln net.Listener,
-	snowflakeClientTransport *snowflakeClient.Transport,
-) error {
-	snowflakeClientConn, err := snowflakeClientTransport.Dial()
+// Listens on the Unix socket at `path`, replacing a stale socket
+// left by a previous run, and lets only the owner connect to it.
+func listenControlSocket(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	// The socket is created with the permissions from the umask,
+	// so create it in a directory that only we can access,
+	// and only move it to `path` after restricting its permissions.
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".control-socket-")
 	if err != nil {
-		// TODO should we retry? With a timeout?
-		log.Print("Snowflake dial failed", err)
-		return err
+		return nil, err
 	}
-	defer snowflakeClientConn.Close()
-	// TODO it looks like the connection doesn't actually get fully closed.
-	// You can reproduce by doing a bunch of
-	// `curl localhost:2080` + Ctrl + C.
-	// The client will be printing `Traffic Bytes (in|out)`
-	// a lot more frequently.
-	// Maybe we really need to create a new `snowflakeClientTransport`
-	// for each `ln.Accept()`.
-
-	netConn, err := ln.Accept()
+	defer os.RemoveAll(dir)
+	tmpPath := filepath.Join(dir, "socket")
+	ln, err := net.Listen("unix", tmpPath)
 	if err != nil {
-		log.Print("Failed to accept connection", err)
-		if err, ok := err.(net.Error); ok && err.Temporary() {
-			return nil
-		}
-		// TODO is this what we want? This will terminate the client.
-		return err
+		return nil, err
 	}
-	defer netConn.Close()
-	log.Printf(
-		"Got new connection from %v! Forwarding",
-		netConn.RemoteAddr().String(),
-	)
+	// Otherwise closing the listener would remove `tmpPath`
+	// and not `path`.
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmpPath, 0o600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &unlinkingListener{Listener: ln, path: path}, nil
+}
 
-	// Perhaps instead of blocking here we could make a new
-	// Snowflake client connection per each network connection,
-	// instead of never doing `ln.Accept()`.
-	// Though remember that apparently `snowflakeClientTransport.Dial()`
-	// closes all the previous `snowflakeClientConn` for the instance of
-	// `snowflakeClientTransport`,
-	// so a new `snowflakeClientTransport` needs to be created every time.
+// Removes the socket file when closed.
+type unlinkingListener struct {
+	net.Listener
+	path string
+}
 
-	// TODO should we utilize `shutdownChan`?
-	shutdownChan := make(chan struct{})
-	common.CopyLoop(snowflakeClientConn, netConn, shutdownChan)
-	log.Printf(
-		"Connection ended %v",
-		netConn.RemoteAddr().String(),
-	)
+func (l *unlinkingListener) Close() error {
+	err := l.Listener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// The log output, which the control API can turn off and on.
+type switchableWriter struct {
+	io.Writer
+	off atomic.Bool
+}
+
+func (w *switchableWriter) Write(b []byte) (int, error) {
+	if w.off.Load() {
+		return len(b), nil
+	}
+	return w.Writer.Write(b)
+}
 
-	return nil
+func (w *switchableWriter) setEnabled(enabled bool) {
+	w.off.Store(!enabled)
 }
@@ -0,0 +1,634 @@
+package common
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// FeatureBonding means that the side can bond several Snowflake connections
+// (through different proxies) into one connection, see `Bond`.
+const FeatureBonding = "bonding"
+
+// BondHello is sent by the client in `Hello.Bond` to make the connection
+// a path of a bond, instead of a regular connection.
+// It only has effect if `FeatureBonding` is negotiated.
+type BondHello struct {
+	// ID is a random ID of the bond, the same for all of its paths.
+	ID string `json:"id"`
+	// Join is set when adding a path to an existing bond,
+	// as opposed to creating a new one. The server only adds it
+	// if `Hello.ClientID` and `Hello.Token` are the same as
+	// for the path that created the bond.
+	Join bool `json:"join,omitempty"`
+}
+
+// NewBondID generates a random `BondHello.ID`.
+func NewBondID() string {
+	return NewClientID()
+}
+
+// BondPathTimeout is how long a bond stays alive without any paths,
+// waiting for the client to add a new one.
+const BondPathTimeout = 2 * time.Minute
+
+// ErrBondUnknown means that the server doesn't have the bond
+// that the client tried to add a path to.
+// It probably has expired, or the server has been restarted.
+var ErrBondUnknown = errors.New("the server does not know this bond")
+
+var errBondNoPaths = errors.New("bond: no paths for too long")
+
+// Every path carries frames that start with the type byte.
+const (
+	// seq(8) length(2) payload
+	bondFrameData = 0
+	// seq(8): all the segments before `seq` have been consumed,
+	// so the sender may forget them.
+	bondFrameAck = 1
+	// seq(8): all the segments before `seq` have been received.
+	// Sent first on every new path, so that the other side retransmits
+	// what could have been lost with a path that it doesn't know is dead.
+	bondFrameResync = 2
+	// seq(8): the sender has closed the bond after sending `seq` segments.
+	bondFrameFin = 3
+	// The server doesn't know the bond. No fields.
+	bondFrameReject = 4
+)
+
+const (
+	bondMaxSegmentSize = 8 * 1024
+	// How many bytes may be sent and not acknowledged yet.
+	bondSendWindow = 2 * 1024 * 1024
+	// How many segments may be sent and not acknowledged yet,
+	// so that small writes don't make the window too long either.
+	bondSendWindowSegments = 4096
+	// How many bytes the receiver buffers at most. The sender's window
+	// can be exceeded by one segment, see `Write()`.
+	// A peer that sends more than that is misbehaving.
+	bondMaxBufferedBytes = bondSendWindow + bondMaxSegmentSize
+	// How long `Close()` waits for the data to be sent.
+	bondCloseTimeout = 5 * time.Second
+)
+
+type bondSegment struct {
+	seq     uint64
+	payload []byte
+	// The path that the segment has last been sent on.
+	path *bondPath
+	// Whether it's in `Bond.pending`.
+	queued bool
+	acked  bool
+}
+
+type bondPath struct {
+	conn       net.Conn
+	dead       bool
+	needResync bool
+	// The fin has been taken to be sent.
+	finSent bool
+	// The fin has been written to `conn`.
+	finWritten bool
+	done       chan struct{}
+}
+
+// Bond is a connection that is made of several reliable connections ("paths"),
+// e.g. Snowflake connections through different proxies.
+// Data is split into sequence-numbered segments, which are sent
+// on whichever path is ready, and reassembled in order on the other side.
+// If a path is lost, the segments that could have been lost with it
+// are sent again on the other paths, so the bond survives
+// as long as there is at least one path, or a new one is added
+// within `BondPathTimeout`.
+//
+// Both the client and the server make a `Bond` with the same ID
+// and add the paths to it with `AddPath`.
+type Bond struct {
+	id string
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	paths []*bondPath
+	// The first path, for `LocalAddr()` and `RemoteAddr()`.
+	firstConn    net.Conn
+	noPathsTimer *time.Timer
+
+	// Sending.
+	nextSeq      uint64
+	unacked      []*bondSegment
+	unackedBytes int
+	// Segments to be sent, ordered by `seq`.
+	pending []*bondSegment
+	closing bool
+
+	// Receiving.
+	recvNext   uint64
+	outOfOrder map[uint64][]byte
+	// In-order segments that haven't been read yet.
+	readQueue [][]byte
+	// The bytes in `outOfOrder` and `readQueue`.
+	bufferedBytes int
+	// The number of segments that have been read completely.
+	consumed uint64
+	// The `consumed` value that we have sent in an ack.
+	ackSent     uint64
+	remoteFin   bool
+	remoteFinAt uint64
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	// Set when the bond is closed.
+	err  error
+	done chan struct{}
+}
+
+// NewBond creates a bond without paths.
+// It fails if no path is added within `BondPathTimeout`.
+func NewBond(id string) *Bond {
+	b := &Bond{
+		id:         id,
+		outOfOrder: make(map[uint64][]byte),
+		done:       make(chan struct{}),
+	}
+	b.cond = sync.NewCond(&b.mu)
+	b.noPathsTimer = time.AfterFunc(BondPathTimeout, func() {
+		b.closeWithError(errBondNoPaths)
+	})
+	return b
+}
+
+// ID returns the ID of the bond.
+func (b *Bond) ID() string {
+	return b.id
+}
+
+// Done is closed when the bond is closed.
+func (b *Bond) Done() <-chan struct{} {
+	return b.done
+}
+
+// PathCount returns the number of the live paths.
+func (b *Bond) PathCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.paths)
+}
+
+// AddPath starts using `conn` as a path of the bond.
+// The returned channel is closed when the path is lost,
+// after which `conn` is closed.
+func (b *Bond) AddPath(conn net.Conn) (<-chan struct{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return nil, b.err
+	}
+	p := &bondPath{
+		conn:       conn,
+		needResync: true,
+		done:       make(chan struct{}),
+	}
+	b.paths = append(b.paths, p)
+	if b.firstConn == nil {
+		b.firstConn = conn
+	}
+	b.noPathsTimer.Stop()
+	// Let the new path send an ack in case it has been lost
+	// with another path.
+	b.ackSent = 0
+
+	go b.pathReader(p)
+	go b.pathWriter(p)
+	return p.done, nil
+}
+
+// RejectBondPath tells the client that the bond that it tried
+// to add the path to doesn't exist. See `ErrBondUnknown`.
+func RejectBondPath(conn net.Conn) error {
+	_, err := conn.Write([]byte{bondFrameReject})
+	return err
+}
+
+func (b *Bond) pathWriter(p *bondPath) {
+	for {
+		frame, hasFin, ok := b.nextFrame(p)
+		if !ok {
+			return
+		}
+		if _, err := p.conn.Write(frame); err != nil {
+			b.pathFailed(p)
+			return
+		}
+		if hasFin {
+			b.mu.Lock()
+			p.finWritten = true
+			b.cond.Broadcast()
+			b.mu.Unlock()
+		}
+	}
+}
+
+// Waits for something to send on the path, and returns it,
+// and whether it includes the fin.
+// Returns `ok == false` when the path is not usable anymore.
+func (b *Bond) nextFrame(p *bondPath) (frame []byte, hasFin bool, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		if p.dead || b.err != nil {
+			return nil, false, false
+		}
+		frame = nil
+		if p.needResync {
+			p.needResync = false
+			frame = append(frame, bondFrameResync)
+			frame = binary.BigEndian.AppendUint64(frame, b.recvNext)
+		}
+		if b.consumed > b.ackSent {
+			b.ackSent = b.consumed
+			frame = append(frame, bondFrameAck)
+			frame = binary.BigEndian.AppendUint64(frame, b.consumed)
+		}
+		for len(b.pending) > 0 {
+			seg := b.pending[0]
+			b.pending = b.pending[1:]
+			seg.queued = false
+			if seg.acked {
+				continue
+			}
+			seg.path = p
+			frame = append(frame, bondFrameData)
+			frame = binary.BigEndian.AppendUint64(frame, seg.seq)
+			frame = binary.BigEndian.AppendUint16(frame, uint16(len(seg.payload)))
+			frame = append(frame, seg.payload...)
+			break
+		}
+		if b.closing && len(b.pending) == 0 && !p.finSent {
+			p.finSent = true
+			hasFin = true
+			frame = append(frame, bondFrameFin)
+			frame = binary.BigEndian.AppendUint64(frame, b.nextSeq)
+		}
+		if len(frame) > 0 {
+			return frame, hasFin, true
+		}
+		b.cond.Wait()
+	}
+}
+
+func (b *Bond) pathReader(p *bondPath) {
+	r := bufio.NewReader(p.conn)
+	err := b.readFrames(r)
+	if err == ErrBondUnknown {
+		b.closeWithError(err)
+	}
+	b.pathFailed(p)
+}
+
+func (b *Bond) readFrames(r *bufio.Reader) error {
+	var seqBytes [8]byte
+	for {
+		frameType, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if frameType == bondFrameReject {
+			return ErrBondUnknown
+		}
+		if _, err := io.ReadFull(r, seqBytes[:]); err != nil {
+			return err
+		}
+		seq := binary.BigEndian.Uint64(seqBytes[:])
+
+		switch frameType {
+		case bondFrameData:
+			var length [2]byte
+			if _, err := io.ReadFull(r, length[:]); err != nil {
+				return err
+			}
+			payload := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return err
+			}
+			if err := b.receive(seq, payload); err != nil {
+				return err
+			}
+		case bondFrameAck:
+			b.handleAck(seq)
+		case bondFrameResync:
+			b.handleResync(seq)
+		case bondFrameFin:
+			b.handleFin(seq)
+		default:
+			return fmt.Errorf("bond: unknown frame type %v", frameType)
+		}
+	}
+}
+
+var errBondOutOfWindow = errors.New("bond: the peer has sent more than its window")
+
+// Returns an error if the peer doesn't respect the window,
+// which only a misbehaving peer does, so that it can't make us
+// buffer an unlimited amount of data.
+func (b *Bond) receive(seq uint64, payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if seq < b.recvNext {
+		// A retransmission of what we already have.
+		return nil
+	}
+	if _, ok := b.outOfOrder[seq]; ok {
+		return nil
+	}
+	// The sender can't have more than that unacknowledged,
+	// and we only acknowledge what has been consumed.
+	if seq-b.consumed >= bondSendWindowSegments ||
+		b.bufferedBytes+len(payload) > bondMaxBufferedBytes {
+		return errBondOutOfWindow
+	}
+	b.bufferedBytes += len(payload)
+	if seq > b.recvNext {
+		b.outOfOrder[seq] = payload
+		return nil
+	}
+	b.readQueue = append(b.readQueue, payload)
+	b.recvNext++
+	for {
+		next, ok := b.outOfOrder[b.recvNext]
+		if !ok {
+			break
+		}
+		delete(b.outOfOrder, b.recvNext)
+		b.readQueue = append(b.readQueue, next)
+		b.recvNext++
+	}
+	b.cond.Broadcast()
+	return nil
+}
+
+func (b *Bond) handleAck(seq uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(b.unacked) > 0 && b.unacked[0].seq < seq {
+		seg := b.unacked[0]
+		seg.acked = true
+		b.unackedBytes -= len(seg.payload)
+		b.unacked = b.unacked[1:]
+	}
+	b.cond.Broadcast()
+}
+
+// The other side has a new path. Send again what it hasn't received,
+// because it might have been lost with a path that we don't know is dead.
+func (b *Bond) handleResync(seq uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, seg := range b.unacked {
+		if seg.seq >= seq {
+			b.requeueLocked(seg)
+		}
+	}
+	b.cond.Broadcast()
+}
+
+func (b *Bond) handleFin(seq uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remoteFin = true
+	b.remoteFinAt = seq
+	b.cond.Broadcast()
+}
+
+// Must be called with `b.mu` held.
+func (b *Bond) requeueLocked(seg *bondSegment) {
+	if seg.queued || seg.acked {
+		return
+	}
+	seg.queued = true
+	i, _ := slices.BinarySearchFunc(b.pending, seg.seq, func(s *bondSegment, seq uint64) int {
+		switch {
+		case s.seq < seq:
+			return -1
+		case s.seq > seq:
+			return 1
+		}
+		return 0
+	})
+	b.pending = slices.Insert(b.pending, i, seg)
+}
+
+func (b *Bond) pathFailed(p *bondPath) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if p.dead {
+		return
+	}
+	p.dead = true
+	p.conn.Close()
+	close(p.done)
+	b.paths = slices.DeleteFunc(b.paths, func(other *bondPath) bool {
+		return other == p
+	})
+	for _, seg := range b.unacked {
+		if seg.path == p {
+			b.requeueLocked(seg)
+		}
+	}
+	// The ack might have been lost with the path.
+	b.ackSent = 0
+	if len(b.paths) == 0 && b.err == nil {
+		b.noPathsTimer.Reset(BondPathTimeout)
+	}
+	b.cond.Broadcast()
+}
+
+// Waits on `b.cond` until it's signaled or `deadline` passes.
+// Must be called with `b.mu` held.
+func (b *Bond) waitLocked(deadline time.Time) error {
+	if !deadline.IsZero() {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.AfterFunc(timeout, func() {
+			b.mu.Lock()
+			b.cond.Broadcast()
+			b.mu.Unlock()
+		})
+		defer timer.Stop()
+	}
+	b.cond.Wait()
+	return nil
+}
+
+func (b *Bond) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(b.readQueue) == 0 {
+		if b.remoteFin && b.consumed >= b.remoteFinAt {
+			return 0, io.EOF
+		}
+		if b.err != nil {
+			return 0, b.err
+		}
+		if err := b.waitLocked(b.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, b.readQueue[0])
+	b.readQueue[0] = b.readQueue[0][n:]
+	b.bufferedBytes -= n
+	if len(b.readQueue[0]) == 0 {
+		b.readQueue = b.readQueue[1:]
+		b.consumed++
+		b.cond.Broadcast()
+	}
+	return n, nil
+}
+
+func (b *Bond) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	written := 0
+	for written < len(p) {
+		for (b.unackedBytes >= bondSendWindow || len(b.unacked) >= bondSendWindowSegments) &&
+			b.err == nil && !b.closing {
+			if err := b.waitLocked(b.writeDeadline); err != nil {
+				return written, err
+			}
+		}
+		if b.err != nil {
+			return written, b.err
+		}
+		if b.closing || b.remoteFin {
+			return written, io.ErrClosedPipe
+		}
+		size := min(len(p)-written, bondMaxSegmentSize)
+		seg := &bondSegment{
+			seq:     b.nextSeq,
+			payload: slices.Clone(p[written : written+size]),
+		}
+		b.nextSeq++
+		b.unacked = append(b.unacked, seg)
+		b.unackedBytes += size
+		b.requeueLocked(seg)
+		written += size
+		b.cond.Broadcast()
+	}
+	return written, nil
+}
+
+// Close sends the remaining data and closes the bond and all of its paths.
+// It waits up to `bondCloseTimeout` for the other side
+// to acknowledge the data, unless the other side has closed the bond
+// as well, in which case it's not going to read it anyway.
+func (b *Bond) Close() error {
+	b.mu.Lock()
+	if b.err != nil {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closing = true
+	b.cond.Broadcast()
+	deadline := time.Now().Add(bondCloseTimeout)
+	// If the other side has closed the bond, it is not going
+	// to add a path to receive our fin.
+	for b.err == nil && !b.closeDoneLocked() &&
+		!(b.remoteFin && len(b.paths) == 0) {
+		if b.waitLocked(deadline) != nil {
+			break
+		}
+	}
+	b.mu.Unlock()
+	b.closeWithError(net.ErrClosed)
+	return nil
+}
+
+// Whether the fin has been written on a live path,
+// and the data has been acknowledged.
+// Must be called with `b.mu` held.
+func (b *Bond) closeDoneLocked() bool {
+	if len(b.unacked) > 0 && !b.remoteFin {
+		return false
+	}
+	for _, p := range b.paths {
+		if p.finWritten {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Bond) closeWithError(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return
+	}
+	b.err = err
+	b.noPathsTimer.Stop()
+	for _, p := range b.paths {
+		p.dead = true
+		p.conn.Close()
+		close(p.done)
+	}
+	b.paths = nil
+	close(b.done)
+	b.cond.Broadcast()
+}
+
+func (b *Bond) LocalAddr() net.Addr {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.firstConn == nil {
+		return bondAddr(b.id)
+	}
+	return b.firstConn.LocalAddr()
+}
+
+func (b *Bond) RemoteAddr() net.Addr {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.firstConn == nil {
+		return bondAddr(b.id)
+	}
+	return b.firstConn.RemoteAddr()
+}
+
+func (b *Bond) SetDeadline(t time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.readDeadline = t
+	b.writeDeadline = t
+	b.cond.Broadcast()
+	return nil
+}
+
+func (b *Bond) SetReadDeadline(t time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.readDeadline = t
+	b.cond.Broadcast()
+	return nil
+}
+
+func (b *Bond) SetWriteDeadline(t time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.writeDeadline = t
+	b.cond.Broadcast()
+	return nil
+}
+
+type bondAddr string
+
+func (a bondAddr) Network() string { return "bond" }
+func (a bondAddr) String() string  { return string(a) }
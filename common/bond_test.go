@@ -0,0 +1,217 @@
+package common
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func bondDataFrame(seq uint64, payload []byte) []byte {
+	frame := []byte{bondFrameData}
+	frame = binary.BigEndian.AppendUint64(frame, seq)
+	frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	return append(frame, payload...)
+}
+
+func bondFinFrame(seq uint64) []byte {
+	return binary.BigEndian.AppendUint64([]byte{bondFrameFin}, seq)
+}
+
+// Adds a path to `b` and returns the other end of it,
+// which the test writes raw frames to.
+// What the bond sends on it is discarded.
+func addRawBondPath(t *testing.T, b *Bond) (net.Conn, <-chan struct{}) {
+	t.Helper()
+	bondEnd, rawEnd := net.Pipe()
+	done, err := b.AddPath(bondEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(io.Discard, rawEnd)
+	return rawEnd, done
+}
+
+func addBondPath(t *testing.T, a, b *Bond) {
+	t.Helper()
+	aEnd, bEnd := net.Pipe()
+	if _, err := a.AddPath(aEnd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.AddPath(bEnd); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func randomBytes(n int) []byte {
+	data := make([]byte, n)
+	rand.Read(data)
+	return data
+}
+
+// Reads from `r` until EOF, failing the test if it takes too long.
+func readAllWithTimeout(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+	type result struct {
+		data []byte
+		err  error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		data, err := io.ReadAll(r)
+		resultCh <- result{data, err}
+	}()
+	select {
+	case res := <-resultCh:
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		return res.data
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out reading")
+		return nil
+	}
+}
+
+func TestBondReordered(t *testing.T) {
+	b := NewBond(NewBondID())
+	defer b.Close()
+	path1, _ := addRawBondPath(t, b)
+	path2, _ := addRawBondPath(t, b)
+
+	path2.Write(bondDataFrame(2, []byte("c")))
+	path1.Write(bondDataFrame(1, []byte("b")))
+	path2.Write(bondDataFrame(0, []byte("a")))
+	// A retransmission must not be delivered twice.
+	path1.Write(bondDataFrame(1, []byte("b")))
+	path1.Write(bondFinFrame(3))
+
+	data := readAllWithTimeout(t, b)
+	if string(data) != "abc" {
+		t.Fatalf("got %q, want %q", data, "abc")
+	}
+}
+
+// Counts the bytes written to the connection.
+type countingTestConn struct {
+	net.Conn
+	written atomic.Int64
+}
+
+func (c *countingTestConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func TestBondPathDies(t *testing.T) {
+	a := NewBond(NewBondID())
+	b := NewBond(a.ID())
+	defer a.Close()
+	defer b.Close()
+
+	// What `a` sends on this path is lost, as if
+	// the path died without the other side knowing.
+	lostEnd, sinkEnd := net.Pipe()
+	lost := &countingTestConn{Conn: lostEnd}
+	go io.Copy(io.Discard, sinkEnd)
+	if _, err := a.AddPath(lost); err != nil {
+		t.Fatal(err)
+	}
+	addBondPath(t, a, b)
+
+	data := randomBytes(512 * 1024)
+	go func() {
+		a.Write(data)
+		// Let some data go to the lost path before it dies.
+		deadline := time.Now().Add(time.Second)
+		for lost.written.Load() < bondMaxSegmentSize && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		t.Logf("%v bytes have been lost with the path", lost.written.Load())
+		sinkEnd.Close()
+		a.Close()
+	}()
+
+	received := readAllWithTimeout(t, b)
+	if !bytes.Equal(received, data) {
+		t.Fatalf("received %v bytes, not the same as the %v sent", len(received), len(data))
+	}
+}
+
+func TestBondCloseDrains(t *testing.T) {
+	a := NewBond(NewBondID())
+	b := NewBond(a.ID())
+	defer b.Close()
+	addBondPath(t, a, b)
+	addBondPath(t, a, b)
+
+	data := randomBytes(1024 * 1024)
+	closed := make(chan struct{})
+	go func() {
+		a.Write(data)
+		a.Close()
+		close(closed)
+	}()
+
+	// Read slowly, so that `Close()` has to wait for it.
+	time.Sleep(100 * time.Millisecond)
+	received := readAllWithTimeout(t, b)
+	if !bytes.Equal(received, data) {
+		t.Fatalf("received %v bytes, not the same as the %v sent", len(received), len(data))
+	}
+	select {
+	case <-closed:
+	case <-time.After(bondCloseTimeout):
+		t.Fatal("Close() hasn't returned after the data has been read")
+	}
+}
+
+func TestBondRejectsOutOfWindow(t *testing.T) {
+	t.Run("sequence number", func(t *testing.T) {
+		b := NewBond(NewBondID())
+		// It has no paths left to send the fin on.
+		defer b.closeWithError(net.ErrClosed)
+		path, done := addRawBondPath(t, b)
+
+		path.Write(bondDataFrame(bondSendWindowSegments, []byte("x")))
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the path hasn't been closed")
+		}
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		b := NewBond(NewBondID())
+		// It has no paths left to send the fin on.
+		defer b.closeWithError(net.ErrClosed)
+		path, done := addRawBondPath(t, b)
+
+		// Without the first segment nothing can be read,
+		// so all of them have to be buffered.
+		payload := make([]byte, bondMaxSegmentSize)
+		go func() {
+			for seq := uint64(1); seq < bondSendWindowSegments; seq++ {
+				if _, err := path.Write(bondDataFrame(seq, payload)); err != nil {
+					return
+				}
+			}
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the path hasn't been closed")
+		}
+		b.mu.Lock()
+		buffered := b.bufferedBytes
+		b.mu.Unlock()
+		if buffered > bondMaxBufferedBytes {
+			t.Fatalf("buffered %v bytes, more than %v", buffered, bondMaxBufferedBytes)
+		}
+	})
+}
@@ -10,7 +10,7 @@ import (
 // https://gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/-/blob/f4db64612c500be635dc7eb231505e88552e6a07/proxy/lib/snowflake.go#L307-335
 // Pipes data between the two connections.
 // Returns when piping at either end fails.
-func CopyLoop(c1 io.ReadWriteCloser, c2 io.ReadWriteCloser, shutdown chan struct{}) {
+func CopyLoop(c1 io.ReadWriteCloser, c2 io.ReadWriteCloser, shutdown <-chan struct{}) {
 	var once sync.Once
 	done := make(chan struct{})
 	copyer := func(dst io.ReadWriteCloser, src io.ReadWriteCloser) {
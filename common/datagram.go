@@ -0,0 +1,208 @@
+package common
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+)
+
+// FeatureDatagramFraming means that in UDP mode the connections
+// to the destination carry length-prefixed datagrams
+// instead of a byte stream, see `NewDatagramConn`.
+// Only the server in UDP mode and the client in UDP mode offer it.
+//
+// This is NOT an unreliable data path: the datagrams still go
+// through KCP and smux, so they are retransmitted and delivered in order.
+// It only avoids piling up stale datagrams when the Snowflake connection
+// is slow, which is what makes e.g. WireGuard over a reliable transport
+// melt down.
+//
+// An unreliable, unordered path is deferred. The WebRTC data channel
+// to the proxy is already unordered and unreliable, but KCP runs
+// on top of it inside the Snowflake library, and all that the library
+// gives us is an smux stream over KCP, on both the client
+// (`Transport.Dial()`) and the server (`SnowflakeListener.Accept()`).
+// So it requires the library to expose its packet connections, see
+// https://gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/-/issues/40352
+// Also, proxies talk to the server over WebSocket, i.e. TCP,
+// though it's the proxy's WebRTC side where packets usually get lost.
+// The feature name "datagrams" is left for that.
+const FeatureDatagramFraming = "datagram-framing"
+
+// MaxDatagramSize is the largest datagram that fits in a frame.
+const MaxDatagramSize = 0xffff
+
+// How many datagrams are waiting to be sent before the oldest ones
+// get dropped.
+const datagramQueueSize = 128
+
+var errDatagramTooBig = errors.New("the datagram is too big")
+
+// DatagramConn sends each `Write()` as a single datagram
+// and returns a single datagram per `Read()`,
+// truncating it if `b` is too short, like UDP does.
+//
+// Writes never block: if the underlying connection can't keep up,
+// the oldest queued datagrams are dropped, so that the ones that go through
+// are as fresh as possible.
+type DatagramConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	queue chan []byte
+
+	mu       sync.Mutex
+	writeErr error
+	dropped  int
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewDatagramConn wraps a connection on which both sides
+// have negotiated `FeatureDatagramFraming`.
+func NewDatagramConn(conn net.Conn) *DatagramConn {
+	c := &DatagramConn{
+		Conn:   conn,
+		r:      bufio.NewReaderSize(conn, 2+MaxDatagramSize),
+		queue:  make(chan []byte, datagramQueueSize),
+		closed: make(chan struct{}),
+	}
+	go c.writeLoop()
+	return c
+}
+
+func (c *DatagramConn) writeLoop() {
+	for {
+		var frame []byte
+		select {
+		case frame = <-c.queue:
+		case <-c.closed:
+			return
+		}
+		if _, err := c.Conn.Write(frame); err != nil {
+			c.mu.Lock()
+			c.writeErr = err
+			c.mu.Unlock()
+			c.Close()
+			return
+		}
+	}
+}
+
+func (c *DatagramConn) Write(b []byte) (int, error) {
+	if len(b) > MaxDatagramSize {
+		return 0, errDatagramTooBig
+	}
+	select {
+	case <-c.closed:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.writeErr != nil {
+			return 0, c.writeErr
+		}
+		return 0, net.ErrClosed
+	default:
+	}
+
+	frame := make([]byte, 0, 2+len(b))
+	frame = binary.BigEndian.AppendUint16(frame, uint16(len(b)))
+	frame = append(frame, b...)
+	for {
+		select {
+		case c.queue <- frame:
+			return len(b), nil
+		default:
+		}
+		select {
+		case <-c.queue:
+			c.mu.Lock()
+			c.dropped++
+			c.mu.Unlock()
+		default:
+		}
+	}
+}
+
+// Must not be called concurrently.
+func (c *DatagramConn) Read(b []byte) (int, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(header[:]))
+	n, err := io.ReadFull(c.r, b[:min(size, len(b))])
+	if err != nil {
+		return n, err
+	}
+	if _, err := c.r.Discard(size - n); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// WriteTo writes every datagram to `w` with a single `Write()`,
+// regardless of the buffer size that `io.CopyBuffer` would use.
+func (c *DatagramConn) WriteTo(w io.Writer) (int64, error) {
+	buf := make([]byte, MaxDatagramSize)
+	var written int64
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			if err == io.EOF {
+				return written, nil
+			}
+			return written, err
+		}
+		n, err = w.Write(buf[:n])
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// ReadFrom sends every `Read()` from `r` as a single datagram.
+// `r` is supposed to be a datagram connection, e.g. a UDP one.
+func (c *DatagramConn) ReadFrom(r io.Reader) (int64, error) {
+	buf := make([]byte, MaxDatagramSize)
+	var read int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			read += int64(n)
+			if _, writeErr := c.Write(buf[:n]); writeErr != nil {
+				return read, writeErr
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return read, nil
+			}
+			return read, err
+		}
+	}
+}
+
+func (c *DatagramConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.Conn.Close()
+		c.mu.Lock()
+		dropped := c.dropped
+		c.mu.Unlock()
+		if dropped > 0 {
+			log.Printf(
+				"Dropped %v datagrams because the Snowflake connection"+
+					" couldn't keep up",
+				dropped,
+			)
+		}
+	})
+	return err
+}
@@ -0,0 +1,81 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func newDatagramConnPair(t *testing.T) (*DatagramConn, *DatagramConn) {
+	t.Helper()
+	aEnd, bEnd := net.Pipe()
+	a, b := NewDatagramConn(aEnd), NewDatagramConn(bEnd)
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+func TestDatagramTruncation(t *testing.T) {
+	a, b := newDatagramConnPair(t)
+	a.Write([]byte("first datagram"))
+	a.Write([]byte("second"))
+
+	b.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 5)
+	for _, want := range []string{"first", "secon"} {
+		n, err := b.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != want {
+			t.Fatalf("got %q, want %q", buf[:n], want)
+		}
+	}
+
+	if _, err := a.Write(make([]byte, MaxDatagramSize+1)); err != errDatagramTooBig {
+		t.Fatalf("got %v, want %v", err, errDatagramTooBig)
+	}
+}
+
+func TestDatagramDropOldest(t *testing.T) {
+	a, b := newDatagramConnPair(t)
+
+	// Nothing is read yet, so all but the first few have to be queued.
+	const count = 2 * datagramQueueSize
+	payload := bytes.Repeat([]byte{0}, 1000)
+	for i := 0; i < count; i++ {
+		binary.BigEndian.PutUint32(payload, uint32(i))
+		if _, err := a.Write(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, len(payload))
+	var received []int
+	for len(received) == 0 || received[len(received)-1] != count-1 {
+		n, err := b.Read(buf)
+		if err != nil {
+			t.Fatalf("%v, after receiving %v", err, received)
+		}
+		if n != len(payload) {
+			t.Fatalf("got %v bytes, want %v", n, len(payload))
+		}
+		index := int(binary.BigEndian.Uint32(buf))
+		if len(received) > 0 && index <= received[len(received)-1] {
+			t.Fatalf("got %v after %v", index, received[len(received)-1])
+		}
+		received = append(received, index)
+	}
+	if len(received) > datagramQueueSize+2 {
+		t.Fatalf("got %v datagrams, more than the queue holds", len(received))
+	}
+	// The newest ones must not have been dropped.
+	if received[len(received)-datagramQueueSize] != count-datagramQueueSize {
+		t.Fatalf("the newest datagrams have been dropped: got %v", received)
+	}
+}
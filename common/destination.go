@@ -0,0 +1,111 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FeatureDestinations means that in mux mode every stream starts
+// with a destination header (see `WriteDestinationRequest`),
+// i.e. the client chooses where each connection goes,
+// instead of the server's configured destination.
+// The client only offers it when it needs it (e.g. in TUN mode),
+// and the server only when it's explicitly allowed, because this
+// makes the server an open proxy for its clients.
+//
+// Streams to "udp" destinations carry datagrams, see `NewDatagramConn`.
+const FeatureDestinations = "destinations"
+
+const (
+	destinationNetworkTCP = 1
+	destinationNetworkUDP = 2
+)
+
+// Sent by the server in response to the destination header.
+const (
+	DestinationOK byte = iota
+	// The server failed to connect to the destination.
+	DestinationUnreachable
+	// The server's access control list doesn't allow the destination.
+	DestinationForbidden
+)
+
+// ErrDestinationUnreachable is returned by `ReadDestinationResponse`
+// if the server failed to connect to the destination.
+var ErrDestinationUnreachable = errors.New("the server failed to connect to the destination")
+
+// ErrDestinationForbidden is returned by `ReadDestinationResponse`
+// if the server's access control list doesn't allow the destination.
+var ErrDestinationForbidden = errors.New("the server doesn't allow connecting to the destination")
+
+// WriteDestinationRequest writes the destination header:
+// the network (1 byte), the address length (1 byte), and the address,
+// which is "host:port".
+// `network` is "tcp" or "udp".
+func WriteDestinationRequest(w io.Writer, network string, address string) error {
+	var networkByte byte
+	switch network {
+	case "tcp":
+		networkByte = destinationNetworkTCP
+	case "udp":
+		networkByte = destinationNetworkUDP
+	default:
+		return fmt.Errorf("unsupported network %q", network)
+	}
+	if len(address) > 0xff {
+		return fmt.Errorf("the address is too long: %q", address)
+	}
+	msg := make([]byte, 0, 2+len(address))
+	msg = append(msg, networkByte, byte(len(address)))
+	msg = append(msg, address...)
+	_, err := w.Write(msg)
+	return err
+}
+
+// ReadDestinationRequest reads what `WriteDestinationRequest` wrote.
+func ReadDestinationRequest(r io.Reader) (network string, address string, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", "", err
+	}
+	switch header[0] {
+	case destinationNetworkTCP:
+		network = "tcp"
+	case destinationNetworkUDP:
+		network = "udp"
+	default:
+		return "", "", fmt.Errorf("unsupported network %v", header[0])
+	}
+	addressBytes := make([]byte, header[1])
+	if _, err := io.ReadFull(r, addressBytes); err != nil {
+		return "", "", err
+	}
+	return network, string(addressBytes), nil
+}
+
+// WriteDestinationResponse tells the client whether the server
+// has connected to the destination. See `DestinationOK`.
+func WriteDestinationResponse(w io.Writer, status byte) error {
+	_, err := w.Write([]byte{status})
+	return err
+}
+
+// ReadDestinationResponse returns `nil` if the server
+// has connected to the destination.
+func ReadDestinationResponse(r io.Reader) error {
+	var status [1]byte
+	if _, err := io.ReadFull(r, status[:]); err != nil {
+		return err
+	}
+	switch status[0] {
+	case DestinationOK:
+		return nil
+	case DestinationUnreachable:
+		return ErrDestinationUnreachable
+	case DestinationForbidden:
+		return ErrDestinationForbidden
+	default:
+		return fmt.Errorf("unknown destination response %v", status[0])
+	}
+}
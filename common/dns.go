@@ -0,0 +1,44 @@
+package common
+
+import (
+	"fmt"
+	"io"
+)
+
+// FeatureDNS means that in mux mode every stream starts
+// with a stream type byte (see `WriteStreamType`),
+// so that the client can send DNS queries through `StreamTypeDNS` streams
+// to a resolver chosen by the server, and not leak them locally.
+// The client only offers it when it needs it,
+// and the server only when it has a resolver configured.
+const FeatureDNS = "dns"
+
+const (
+	// StreamTypeConnection is a regular stream, i.e. the same as
+	// without `FeatureDNS`. If `FeatureDestinations` is used,
+	// the destination header follows.
+	StreamTypeConnection byte = iota
+	// StreamTypeDNS is DNS over TCP (RFC 7766), i.e. each message
+	// is prefixed with its length (2 bytes), to the server's resolver.
+	StreamTypeDNS
+)
+
+// WriteStreamType writes the stream type, see `FeatureDNS`.
+func WriteStreamType(w io.Writer, streamType byte) error {
+	_, err := w.Write([]byte{streamType})
+	return err
+}
+
+// ReadStreamType reads what `WriteStreamType` wrote.
+func ReadStreamType(r io.Reader) (byte, error) {
+	var streamType [1]byte
+	if _, err := io.ReadFull(r, streamType[:]); err != nil {
+		return 0, err
+	}
+	switch streamType[0] {
+	case StreamTypeConnection, StreamTypeDNS:
+		return streamType[0], nil
+	default:
+		return 0, fmt.Errorf("unknown stream type %v", streamType[0])
+	}
+}
@@ -0,0 +1,450 @@
+package common
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"time"
+)
+
+// How long we wait for the other side's `Hello`
+// after we know that it does perform the handshake.
+// Getting a Snowflake proxy might take a while, but by the time
+// `Dial()` returns we already have one, so this can be moderate.
+const HandshakeTimeout = 30 * time.Second
+
+// SingleConnFirstByteTimeout is how long the server in single-connection mode
+// waits for the client to send anything before it assumes that
+// the client doesn't perform the handshake, see `ServerHandshake`.
+// The new clients send their `Hello` right away, but a legacy client
+// might be waiting for the destination to speak first (e.g. SSH or SMTP).
+const SingleConnFirstByteTimeout = 5 * time.Second
+
+// The handshake starts with these bytes.
+// The first byte is intentionally not 1 or 2, so that a server
+// that doesn't know about the handshake and treats the connection
+// as an smux session fails right away with `smux.ErrInvalidProtocol`
+// and closes the connection, instead of waiting for more data.
+// 0xff is also not a valid first byte of a SOCKS, TLS or WireGuard message,
+// so a server can tell a legacy client's data from a `Hello`.
+var handshakeMagic = []byte("\xffSFG")
+
+// Incremented on incompatible changes to the `Hello` framing.
+const handshakeFramingVersion = 1
+
+const maxHelloSize = 16 * 1024
+
+// ErrNoHandshake means that the other side doesn't speak the handshake,
+// i.e. it is probably of an older version.
+var ErrNoHandshake = errors.New("the other side did not perform the handshake")
+
+// SupportedSmuxVersions are the smux protocol versions that we can speak,
+// in order of preference.
+// Prior to 2025-01-13 we used version 1.
+var SupportedSmuxVersions = []int{2, 1}
+
+// Optional protocol features that are negotiated during the handshake.
+// A feature is used only if both sides support it.
+var SupportedFeatures = []string{
+	FeatureBonding,
+	FeatureDatagramFraming,
+	FeatureDestinations,
+	FeatureDNS,
+	FeatureReverse,
+}
+
+// Hello is the message that the client and the server exchange
+// right after the Snowflake connection gets established.
+// The client sends its `Hello` first, and the server responds with its own.
+//
+// The server's `Hello` carries the outcome of the negotiation:
+// `SmuxVersions` contains only the chosen version
+// (or nothing if there is no common one),
+// and `Features` contains only the features that both sides support.
+type Hello struct {
+	Build BuildInfo `json:"build"`
+	// ClientID is a random ID that the client picks on startup
+	// and sends on each Snowflake connection, so that the server can tell
+	// that the connections come from the same client,
+	// even though through different proxies.
+	// Only in the client's `Hello`.
+	ClientID string `json:"clientId,omitempty"`
+	// Supported smux versions, in order of preference.
+	SmuxVersions []int    `json:"smuxVersions,omitempty"`
+	Features     []string `json:"features,omitempty"`
+	// Bond makes the connection a path of a bond, see `FeatureBonding`.
+	// Only in the client's `Hello`.
+	Bond *BondHello `json:"bond,omitempty"`
+	// Token identifies the user of the client (e.g. a team)
+	// to a server that has users configured.
+	// Keep in mind that Snowflake proxies can see it.
+	// Only in the client's `Hello`.
+	Token string `json:"token,omitempty"`
+	// Error, if not empty, means that the server has rejected the client,
+	// e.g. because of an unknown `Token`. See `ErrRejected`.
+	// Only in the server's `Hello`.
+	Error string `json:"error,omitempty"`
+}
+
+// NewHello returns a `Hello` describing this binary.
+func NewHello() *Hello {
+	return &Hello{
+		Build:        GetBuildInfo(),
+		SmuxVersions: SupportedSmuxVersions,
+		Features:     SupportedFeatures,
+	}
+}
+
+// RemoveFeature makes us not offer the feature,
+// e.g. because it doesn't apply to our configuration.
+func (h *Hello) RemoveFeature(feature string) {
+	h.Features = slices.DeleteFunc(
+		slices.Clone(h.Features),
+		func(f string) bool { return f == feature },
+	)
+}
+
+// NewClientID generates a random `Hello.ClientID`.
+func NewClientID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// HandshakeResult is what the two sides have agreed on.
+type HandshakeResult struct {
+	// The other side's `Hello`.
+	// `nil` if the other side didn't perform the handshake.
+	Peer        *Hello
+	SmuxVersion int
+	Features    []string
+}
+
+// HasFeature reports whether both sides support the feature.
+func (r *HandshakeResult) HasFeature(feature string) bool {
+	return slices.Contains(r.Features, feature)
+}
+
+// ErrNoCommonSmuxVersion means that the client and the server
+// don't support any smux version in common.
+var ErrNoCommonSmuxVersion = errors.New("no common smux version")
+
+// ErrRejected is returned by `ClientHandshake` if the server
+// has rejected the client, see `Hello.Error`.
+var ErrRejected = errors.New("the server rejected the connection")
+
+// Builds the server's response to the client's `Hello`.
+func negotiate(ours *Hello, clientHello *Hello) *Hello {
+	reply := &Hello{
+		Build:        ours.Build,
+		SmuxVersions: []int{},
+		Features:     []string{},
+	}
+	for _, v := range clientHello.SmuxVersions {
+		if slices.Contains(ours.SmuxVersions, v) {
+			reply.SmuxVersions = append(reply.SmuxVersions, v)
+			break
+		}
+	}
+	for _, f := range clientHello.Features {
+		if slices.Contains(ours.Features, f) {
+			reply.Features = append(reply.Features, f)
+		}
+	}
+	return reply
+}
+
+// Interprets the server's `Hello`.
+func resultFromServerHello(serverHello *Hello, peer *Hello) (*HandshakeResult, error) {
+	if serverHello.Error != "" {
+		return nil, fmt.Errorf("%w: %v", ErrRejected, serverHello.Error)
+	}
+	if len(serverHello.SmuxVersions) == 0 {
+		return nil, ErrNoCommonSmuxVersion
+	}
+	return &HandshakeResult{
+		Peer:        peer,
+		SmuxVersion: serverHello.SmuxVersions[0],
+		Features:    serverHello.Features,
+	}, nil
+}
+
+func writeHello(w io.Writer, hello *Hello) error {
+	payload, err := json.Marshal(hello)
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxHelloSize {
+		return fmt.Errorf("hello is too big: %v bytes", len(payload))
+	}
+	msg := make([]byte, 0, len(handshakeMagic)+1+2+len(payload))
+	msg = append(msg, handshakeMagic...)
+	msg = append(msg, handshakeFramingVersion)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(payload)))
+	msg = append(msg, payload...)
+	_, err = w.Write(msg)
+	return err
+}
+
+// Reads what follows the magic bytes.
+func readHelloBody(r io.Reader) (*Hello, error) {
+	var header [3]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != handshakeFramingVersion {
+		return nil, fmt.Errorf("unsupported handshake framing version %v", header[0])
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[1:]))
+	if len(payload) > maxHelloSize {
+		return nil, fmt.Errorf("hello is too big: %v bytes", len(payload))
+	}
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	var hello Hello
+	if err := json.Unmarshal(payload, &hello); err != nil {
+		return nil, err
+	}
+	return &hello, nil
+}
+
+// ClientHandshake sends our `Hello` and waits for the server's `Hello`.
+//
+// If the server doesn't perform the handshake, `ErrNoHandshake` is returned.
+// In that case the connection should not be used any further,
+// because the server has already received our `Hello`
+// and either closed the connection or passed the `Hello` to the destination.
+// See `ProbeLegacySmuxVersion`.
+//
+// Note that a legacy server in single-connection mode passes our `Hello`
+// to the destination and keeps the connection open, so unless
+// the destination closes it, we only find out after `HandshakeTimeout`.
+// The client remembers that until it's restarted.
+func ClientHandshake(conn net.Conn, hello *Hello) (*HandshakeResult, error) {
+	if err := writeHello(conn, hello); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	magic := make([]byte, len(handshakeMagic))
+	if _, err := io.ReadFull(conn, magic); err != nil {
+		if errors.Is(err, io.EOF) ||
+			errors.Is(err, io.ErrUnexpectedEOF) ||
+			errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, fmt.Errorf("%w: %v", ErrNoHandshake, err)
+		}
+		return nil, err
+	}
+	if !bytes.Equal(magic, handshakeMagic) {
+		return nil, ErrNoHandshake
+	}
+	serverHello, err := readHelloBody(conn)
+	if err != nil {
+		return nil, err
+	}
+	return resultFromServerHello(serverHello, serverHello)
+}
+
+// ServerHandshake reads the client's `Hello` and responds with our `Hello`,
+// which contains the outcome of the negotiation.
+//
+// If the client doesn't perform the handshake, `HandshakeResult.Peer` is `nil`
+// and the returned connection yields all of the client's data,
+// including the bytes that have been read in order to find that out.
+// Otherwise the returned connection is `conn`.
+//
+// `check`, if not `nil`, is called with the client's `Hello`.
+// If it returns an error, the client is rejected with it (see `Hello.Error`).
+//
+// If the client sends nothing for `firstByteTimeout`, it's assumed
+// not to perform the handshake. 0 means no timeout, which is what
+// mux mode needs, because a legacy client in mux mode doesn't send
+// anything until the first stream is opened.
+// In single-connection mode use `SingleConnFirstByteTimeout`.
+func ServerHandshake(
+	conn net.Conn,
+	hello *Hello,
+	check func(clientHello *Hello) error,
+	firstByteTimeout time.Duration,
+) (net.Conn, *HandshakeResult, error) {
+	read := make([]byte, 0, len(handshakeMagic))
+	var firstByte [1]byte
+	if firstByteTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(firstByteTimeout))
+	}
+	_, err := io.ReadFull(conn, firstByte[:])
+	conn.SetReadDeadline(time.Time{})
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return conn, legacyClientResult(nil), nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	read = append(read, firstByte[0])
+	if firstByte[0] != handshakeMagic[0] {
+		return &prefixedConn{Conn: conn, prefix: read}, legacyClientResult(read), nil
+	}
+
+	conn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	rest := make([]byte, len(handshakeMagic)-1)
+	n, err := io.ReadFull(conn, rest)
+	read = append(read, rest[:n]...)
+	if !bytes.Equal(read, handshakeMagic[:len(read)]) {
+		return &prefixedConn{Conn: conn, prefix: read}, legacyClientResult(read), nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	clientHello, err := readHelloBody(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if check != nil {
+		if err := check(clientHello); err != nil {
+			writeHello(conn, &Hello{Build: hello.Build, Error: err.Error()})
+			return nil, nil, fmt.Errorf("rejected the client: %w", err)
+		}
+	}
+	reply := negotiate(hello, clientHello)
+	if err := writeHello(conn, reply); err != nil {
+		return nil, nil, err
+	}
+	result, err := resultFromServerHello(reply, clientHello)
+	if err != nil {
+		return nil, nil, fmt.Errorf(
+			"%w: the client supports %v, we support %v",
+			err,
+			clientHello.SmuxVersions,
+			hello.SmuxVersions,
+		)
+	}
+	return conn, result, nil
+}
+
+// For a legacy client in mux mode the first byte is the version byte
+// of the first smux frame.
+// In single-connection mode the smux version doesn't matter,
+// and the client might not have sent anything.
+func legacyClientResult(firstBytes []byte) *HandshakeResult {
+	smuxVersion := 2
+	if len(firstBytes) > 0 && firstBytes[0] == 1 {
+		smuxVersion = 1
+	}
+	return &HandshakeResult{
+		SmuxVersion: smuxVersion,
+	}
+}
+
+// How long `ProbeLegacySmuxVersion` waits for the server
+// to close the connection.
+const smuxProbeTimeout = 10 * time.Second
+
+// ProbeLegacySmuxVersion finds out whether a server that doesn't perform
+// the handshake (see `ErrNoHandshake`) speaks smux version 2.
+// `conn` must be a fresh connection to the server in mux mode.
+//
+// It sends an smux v2 NOP frame, which a v2 server silently ignores,
+// and which makes a v1 server close the connection
+// because of `smux.ErrInvalidProtocol`.
+// If the server closes the connection, the connection can't be used any further
+// and the returned version is 1.
+// Otherwise the connection can be used as a v2 smux session.
+func ProbeLegacySmuxVersion(conn net.Conn) (version int, connStillUsable bool, err error) {
+	// See https://github.com/xtaci/smux/blob/v1.5.33/frame.go
+	// ver(1) cmd(1) length(2) sid(4)
+	const cmdNOP = 3
+	nopFrame := []byte{2, cmdNOP, 0, 0, 0, 0, 0, 0}
+	if _, err := conn.Write(nopFrame); err != nil {
+		return 0, false, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(smuxProbeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	// The server is not supposed to send anything before we open a stream,
+	// and the read deadline doesn't break the connection.
+	var b [1]byte
+	_, err = conn.Read(b[:])
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return 2, true, nil
+	case errors.Is(err, io.EOF):
+		return 1, false, nil
+	case err != nil:
+		return 0, false, err
+	default:
+		return 0, false, errors.New("unexpected data from the server")
+	}
+}
+
+// LogHandshakeResult logs the build info of the other side of the connection
+// and warns if it differs from ours.
+// `peerName` is "server" or "client".
+func LogHandshakeResult(peerName string, result *HandshakeResult) {
+	if result.Peer == nil {
+		log.Printf(
+			"The %v did not perform the handshake,"+
+				" it is probably of an older version. Using smux v%v",
+			peerName,
+			result.SmuxVersion,
+		)
+		return
+	}
+	ours := GetBuildInfo()
+	theirs := result.Peer.Build
+	log.Printf(
+		"The %v's version: %v. Using smux v%v, features: %v",
+		peerName,
+		theirs.ShortString(),
+		result.SmuxVersion,
+		result.Features,
+	)
+	if theirs.Version != ours.Version || theirs.Revision != ours.Revision {
+		log.Printf(
+			"Warning: the %v's version (%v) differs from ours (%v)."+
+				" If you experience problems, try using the same version",
+			peerName,
+			theirs.ShortString(),
+			ours.ShortString(),
+		)
+	}
+	if theirs.SnowflakeVersion != ours.SnowflakeVersion {
+		log.Printf(
+			"Warning: the %v's Snowflake library version (%v) differs from ours (%v)",
+			peerName,
+			theirs.SnowflakeVersion,
+			ours.SnowflakeVersion,
+		)
+	}
+}
+
+// Yields `prefix` before reading from `Conn`.
+type prefixedConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixedConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
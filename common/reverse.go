@@ -0,0 +1,9 @@
+package common
+
+// FeatureReverse means that in mux mode the server may open streams
+// to the client, like `ssh -R`: every connection that the server accepts
+// on its reverse listener becomes a stream that the client forwards
+// to its local address. These streams have no header.
+// The client only offers it when it has a local address to forward to,
+// and the server only when it has a reverse listener.
+const FeatureReverse = "reverse"
@@ -0,0 +1,112 @@
+package common
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Version can be set at build time, e.g.
+//
+//	go build -ldflags "-X github.com/WofWca/snowflake-generalized/common.Version=v1.2.3" ./client
+//
+// If it's empty, the version of the main module is taken from the build info,
+// which is usually "(devel)" unless the binary was built
+// with `go install ...@version` or from a tagged commit.
+var Version = ""
+
+const snowflakeModulePath = "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2"
+
+// BuildInfo describes the build of the running binary.
+// It is printed with the "-version" flag and is sent to the other side
+// of a Snowflake connection during the handshake (see `Hello`).
+type BuildInfo struct {
+	Version string `json:"version"`
+	// VCS revision (commit hash) that the binary was built from.
+	Revision string `json:"revision,omitempty"`
+	// Whether the working tree had uncommitted changes at build time.
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"goVersion"`
+	// Version of the Snowflake library (or of its fork)
+	// that the binary was built with.
+	SnowflakeVersion string `json:"snowflakeVersion,omitempty"`
+}
+
+var currentBuildInfo = readBuildInfo()
+
+// GetBuildInfo returns the build info of the running binary.
+func GetBuildInfo() BuildInfo {
+	return currentBuildInfo
+}
+
+func readBuildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   Version,
+		GoVersion: runtime.Version(),
+	}
+	debugInfo, ok := debug.ReadBuildInfo()
+	if !ok {
+		if info.Version == "" {
+			info.Version = "unknown"
+		}
+		return info
+	}
+
+	if info.Version == "" {
+		info.Version = debugInfo.Main.Version
+	}
+	for _, setting := range debugInfo.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Revision = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	for _, dep := range debugInfo.Deps {
+		if dep.Path != snowflakeModulePath {
+			continue
+		}
+		// We use a fork of Snowflake, see the `replace` directive in go.mod.
+		if dep.Replace != nil {
+			info.SnowflakeVersion = dep.Replace.Path + " " + dep.Replace.Version
+		} else {
+			info.SnowflakeVersion = dep.Version
+		}
+	}
+	return info
+}
+
+// String returns a human-readable, multi-line representation
+// of the build info, suitable for the "-version" flag output.
+func (info BuildInfo) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "version: %v\n", info.Version)
+	if info.Revision != "" {
+		modifiedStr := ""
+		if info.Modified {
+			modifiedStr = " (modified)"
+		}
+		fmt.Fprintf(&b, "revision: %v%v\n", info.Revision, modifiedStr)
+	}
+	fmt.Fprintf(&b, "go: %v\n", info.GoVersion)
+	if info.SnowflakeVersion != "" {
+		fmt.Fprintf(&b, "snowflake: %v\n", info.SnowflakeVersion)
+	}
+	return b.String()
+}
+
+// ShortString returns a single-line representation of the build info,
+// suitable for log messages.
+func (info BuildInfo) ShortString() string {
+	s := info.Version
+	if info.Revision != "" {
+		s += " (" + info.Revision
+		if info.Modified {
+			s += ", modified"
+		}
+		s += ")"
+	}
+	return s
+}
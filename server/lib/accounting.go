@@ -0,0 +1,257 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// How often `Accounting` writes the usage to the file.
+const accountingFlushInterval = 10 * time.Second
+
+var usageBucket = []byte("usage")
+
+// Usage is how much a user has transferred, in both directions.
+type Usage struct {
+	User string `json:"user"`
+	// Day is the date (UTC) that `DayBytes` is for, "2006-01-02".
+	Day      string `json:"day"`
+	DayBytes int64  `json:"dayBytes"`
+	// Month is the month (UTC) that `MonthBytes` is for, "2006-01".
+	Month      string `json:"month"`
+	MonthBytes int64  `json:"monthBytes"`
+	TotalBytes int64  `json:"totalBytes"`
+}
+
+// Starts a new day or month if it's time to.
+func (u Usage) at(now time.Time) Usage {
+	now = now.UTC()
+	if day := now.Format(time.DateOnly); u.Day != day {
+		u.Day = day
+		u.DayBytes = 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month = month
+		u.MonthBytes = 0
+	}
+	return u
+}
+
+func (u Usage) plus(n int64) Usage {
+	u.DayBytes += n
+	u.MonthBytes += n
+	u.TotalBytes += n
+	return u
+}
+
+// Accounting keeps track of how much every user has transferred
+// (see `Config.Users`) in a bbolt database file.
+//
+// The counters are kept in memory and written to the file periodically,
+// and the file is only opened for that, so that it can be inspected
+// and modified with `ListUsage()` and `ResetUsage()`
+// from another process (e.g. `-usage`) while the server is running.
+type Accounting struct {
+	path string
+
+	mu sync.Mutex
+	// As of the last time the file was read.
+	stored map[string]Usage
+	// Being written to the file by `flush()`, not in `stored` yet.
+	flushing map[string]int64
+	// Not written to the file yet.
+	pending map[string]int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewAccounting reads the usage from the file at `path`,
+// creating it if it doesn't exist, and starts writing
+// the usage to it periodically. Call `Close()` to write the rest.
+func NewAccounting(path string) (*Accounting, error) {
+	a := &Accounting{
+		path:    path,
+		stored:  make(map[string]Usage),
+		pending: make(map[string]int64),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := a.flush(); err != nil {
+		return nil, err
+	}
+	go a.flushLoop()
+	return a, nil
+}
+
+func (a *Accounting) flushLoop() {
+	defer close(a.done)
+	ticker := time.NewTicker(accountingFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := a.flush(); err != nil {
+				log.Print("Failed to save the usage: ", err)
+			}
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// Close writes the usage that hasn't been written yet.
+func (a *Accounting) Close() error {
+	close(a.stop)
+	<-a.done
+	return a.flush()
+}
+
+// Add records that the user has transferred `n` more bytes
+// and returns its usage.
+func (a *Accounting) Add(user string, n int64) Usage {
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pending[user] += n
+	return a.usageLocked(user, now)
+}
+
+// Usage returns the usage of the user.
+func (a *Accounting) Usage(user string) Usage {
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	usage := a.usageLocked(user, now)
+	usage.User = user
+	return usage
+}
+
+// Must be called with `a.mu` held.
+func (a *Accounting) usageLocked(user string, now time.Time) Usage {
+	return a.stored[user].at(now).plus(a.flushing[user] + a.pending[user])
+}
+
+// Adds the pending usage to the file and reads the file back,
+// so that the changes made by other processes are picked up.
+// Must not be called concurrently.
+func (a *Accounting) flush() error {
+	a.mu.Lock()
+	pending := a.pending
+	// Still counted until `stored` has them, because the quotas
+	// are checked while the file is being written.
+	a.flushing = pending
+	a.pending = make(map[string]int64)
+	a.mu.Unlock()
+
+	stored := make(map[string]Usage)
+	err := updateUsage(a.path, func(bucket *bolt.Bucket) error {
+		now := time.Now()
+		for user, n := range pending {
+			usage, err := getUsage(bucket, user)
+			if err != nil {
+				return err
+			}
+			if err := putUsage(bucket, usage.at(now).plus(n)); err != nil {
+				return err
+			}
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var usage Usage
+			if err := json.Unmarshal(v, &usage); err != nil {
+				return err
+			}
+			stored[usage.User] = usage
+			return nil
+		})
+	})
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.flushing = nil
+	if err != nil {
+		// Let's try again the next time.
+		for user, n := range pending {
+			a.pending[user] += n
+		}
+		return err
+	}
+	a.stored = stored
+	return nil
+}
+
+// ListUsage returns the usage of all the users in the accounting file,
+// sorted by name.
+// Keep in mind that a running server writes it every 10 seconds.
+func ListUsage(path string) ([]Usage, error) {
+	var list []Usage
+	err := updateUsage(path, func(bucket *bolt.Bucket) error {
+		now := time.Now()
+		return bucket.ForEach(func(k, v []byte) error {
+			var usage Usage
+			if err := json.Unmarshal(v, &usage); err != nil {
+				return err
+			}
+			list = append(list, usage.at(now))
+			return nil
+		})
+	})
+	slices.SortFunc(list, func(a, b Usage) int { return strings.Compare(a.User, b.User) })
+	return list, err
+}
+
+// ResetUsage resets the daily and the monthly usage of the user
+// in the accounting file, so that it can connect again
+// if it has exceeded its quota. A running server picks it up
+// within 10 seconds.
+func ResetUsage(path string, user string) error {
+	return updateUsage(path, func(bucket *bolt.Bucket) error {
+		usage, err := getUsage(bucket, user)
+		if err != nil {
+			return err
+		}
+		usage = usage.at(time.Now())
+		usage.DayBytes = 0
+		usage.MonthBytes = 0
+		return putUsage(bucket, usage)
+	})
+}
+
+// Opens the file, calls `f` in a read-write transaction, and closes it.
+func updateUsage(path string, f func(bucket *bolt.Bucket) error) error {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(usageBucket)
+		if err != nil {
+			return err
+		}
+		return f(bucket)
+	})
+}
+
+func getUsage(bucket *bolt.Bucket, user string) (Usage, error) {
+	usage := Usage{User: user}
+	if v := bucket.Get([]byte(user)); v != nil {
+		if err := json.Unmarshal(v, &usage); err != nil {
+			return usage, err
+		}
+	}
+	return usage, nil
+}
+
+func putUsage(bucket *bolt.Bucket, usage Usage) error {
+	v, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(usage.User), v)
+}
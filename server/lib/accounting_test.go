@@ -0,0 +1,59 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The usage that is being written to the file must still count,
+// even if writing takes a while, e.g. because `-usage` has the file open.
+func TestAccountingCountsWhileFlushing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.db")
+	a, err := NewAccounting(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	a.Add("team-a", 100)
+
+	// Holds the file lock, so that `flush()` waits for it.
+	db, err := bolt.Open(path, 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flushed := make(chan error, 1)
+	go func() { flushed <- a.flush() }()
+	for {
+		a.mu.Lock()
+		flushing := a.flushing != nil
+		a.mu.Unlock()
+		if flushing {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if usage := a.Usage("team-a"); usage.DayBytes != 100 {
+		t.Fatalf("counted %v bytes while flushing, want 100", usage.DayBytes)
+	}
+	if usage := a.Add("team-a", 1); usage.DayBytes != 101 {
+		t.Fatalf("counted %v bytes while flushing, want 101", usage.DayBytes)
+	}
+
+	db.Close()
+	if err := <-flushed; err != nil {
+		t.Fatal(err)
+	}
+	if usage := a.Usage("team-a"); usage.DayBytes != 101 || usage.MonthBytes != 101 {
+		t.Fatalf("counted %+v after flushing, want 101 bytes", usage)
+	}
+	if err := a.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if usage := a.Usage("team-a"); usage.TotalBytes != 101 {
+		t.Fatalf("counted %+v after flushing again, want 101 bytes", usage)
+	}
+}
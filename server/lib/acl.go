@@ -0,0 +1,282 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/WofWca/snowflake-generalized/common"
+)
+
+// ACL decides which destinations the clients may connect to,
+// see `Config.DestinationACL`.
+//
+// The rules are checked in order, and the first one that matches
+// the destination decides. If none matches, the destination is allowed,
+// unless it's a local address (private, loopback, link-local
+// (e.g. the cloud metadata service 169.254.169.254), carrier-grade NAT,
+// unspecified (0.0.0.0/8) or multicast), like the Snowflake proxy does.
+// So, to allow only some destinations, end the rules with `deny any *`.
+// Local addresses are only allowed by the rules with a `Prefix`,
+// so that e.g. `allow tcp * 80,443` doesn't expose the server's
+// local network, and neither does `allow tcp *.example.com 443`
+// when someone points a subdomain at 127.0.0.1.
+//
+// Hostnames are resolved before checking, and the rules are checked
+// against every resolved address. The connection is then made
+// to one of the allowed addresses, so that the hostname can't resolve
+// to a different address by then (DNS rebinding).
+type ACL struct {
+	Rules []ACLRule
+
+	// Replaces `net.DefaultResolver.LookupNetIP`, for tests.
+	lookupNetIP func(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// ACLRule matches destinations by network, address and port.
+type ACLRule struct {
+	Allow bool
+	// "tcp", "udp", or "" for both.
+	Network string
+	// If valid, the rule only matches the addresses in this range.
+	Prefix netip.Prefix
+	// If not empty, the rule only matches the destinations
+	// that the client requested by this hostname. "*.example.com" matches
+	// all the subdomains of "example.com", but not "example.com" itself.
+	// If both `Prefix` and `Hostname` are empty, any address matches.
+	Hostname string
+	// If not empty, the rule only matches these ports.
+	Ports []PortRange
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	From, To uint16
+}
+
+// ParseACL parses the rules, one per line, in the form
+//
+//	allow|deny tcp|udp|any <address> [<ports>]
+//
+// where `<address>` is an IP address, a CIDR range, a hostname,
+// a wildcard hostname such as "*.example.com", or "*" for any,
+// and `<ports>` is a comma-separated list of ports and port ranges,
+// such as "80,443,8000-8999". Empty lines and lines starting with "#"
+// are ignored. E.g.:
+//
+//	# Only let the clients browse the web.
+//	deny any *.internal.example.com
+//	allow tcp * 80,443
+//	allow udp * 443
+//	deny any *
+func ParseACL(r io.Reader) (*ACL, error) {
+	acl := &ACL{}
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseACLRule(strings.Fields(line))
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", lineNumber, err)
+		}
+		acl.Rules = append(acl.Rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+func parseACLRule(fields []string) (ACLRule, error) {
+	var rule ACLRule
+	if len(fields) < 3 || len(fields) > 4 {
+		return rule, fmt.Errorf(
+			"expected \"allow|deny tcp|udp|any <address> [<ports>]\", got %q",
+			strings.Join(fields, " "),
+		)
+	}
+
+	switch fields[0] {
+	case "allow":
+		rule.Allow = true
+	case "deny":
+	default:
+		return rule, fmt.Errorf("unknown action %q, must be \"allow\" or \"deny\"", fields[0])
+	}
+
+	switch fields[1] {
+	case "tcp", "udp":
+		rule.Network = fields[1]
+	case "any":
+	default:
+		return rule, fmt.Errorf("unknown protocol %q, must be \"tcp\", \"udp\" or \"any\"", fields[1])
+	}
+
+	address := fields[2]
+	if prefix, err := netip.ParsePrefix(address); err == nil {
+		rule.Prefix = prefix.Masked()
+	} else if ip, err := netip.ParseAddr(address); err == nil {
+		rule.Prefix = netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen())
+	} else if address != "*" {
+		rule.Hostname = normalizeHostname(address)
+	}
+
+	if len(fields) == 4 {
+		for _, portsStr := range strings.Split(fields[3], ",") {
+			fromStr, toStr, isRange := strings.Cut(portsStr, "-")
+			from, err := strconv.ParseUint(fromStr, 10, 16)
+			if err != nil {
+				return rule, fmt.Errorf("invalid port %q", fromStr)
+			}
+			to := from
+			if isRange {
+				to, err = strconv.ParseUint(toStr, 10, 16)
+				if err != nil {
+					return rule, fmt.Errorf("invalid port %q", toStr)
+				}
+				if to < from {
+					return rule, fmt.Errorf("invalid port range %q", portsStr)
+				}
+			}
+			rule.Ports = append(rule.Ports, PortRange{uint16(from), uint16(to)})
+		}
+	}
+	return rule, nil
+}
+
+// Resolve checks whether the client may connect to `address` ("host:port")
+// over `network`, and returns the address to connect to,
+// which has the hostname resolved.
+// The returned error wraps `common.ErrDestinationForbidden`
+// if the destination is not allowed.
+func (acl *ACL) Resolve(ctx context.Context, network string, address string) (string, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid port %q", portStr)
+	}
+
+	var hostname string
+	var ips []netip.Addr
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ips = []netip.Addr{ip}
+	} else {
+		hostname = normalizeHostname(host)
+		lookupNetIP := acl.lookupNetIP
+		if lookupNetIP == nil {
+			lookupNetIP = net.DefaultResolver.LookupNetIP
+		}
+		ips, err = lookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		if acl.allows(network, hostname, ip, uint16(port)) {
+			return netip.AddrPortFrom(ip, uint16(port)).String(), nil
+		}
+	}
+	return "", fmt.Errorf("%w: %v %v", common.ErrDestinationForbidden, network, address)
+}
+
+// NewACLDialer returns a `Dialer` that only connects to the destinations
+// that `acl` allows (see `ACL.Resolve()`), with `forward`.
+// Unlike `Config.DestinationACL`, this applies to every connection
+// that is made with the `Dialer`, e.g. to `Config.DestinationAddress`.
+// If `forward` is `nil`, `net.Dialer` is used.
+func NewACLDialer(acl *ACL, forward Dialer) Dialer {
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+	return &aclDialer{acl: acl, forward: forward}
+}
+
+type aclDialer struct {
+	acl     *ACL
+	forward Dialer
+}
+
+func (d *aclDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	resolvedAddress, err := d.acl.Resolve(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return d.forward.DialContext(ctx, network, resolvedAddress)
+}
+
+func (acl *ACL) allows(network string, hostname string, ip netip.Addr, port uint16) bool {
+	for _, rule := range acl.Rules {
+		if rule.matches(network, hostname, ip, port) {
+			// A matching `Prefix` contains the address.
+			if rule.Allow && !rule.Prefix.IsValid() && isLocalAddress(ip) {
+				continue
+			}
+			return rule.Allow
+		}
+	}
+	return !isLocalAddress(ip)
+}
+
+func (rule *ACLRule) matches(network string, hostname string, ip netip.Addr, port uint16) bool {
+	if rule.Network != "" && rule.Network != network {
+		return false
+	}
+	if rule.Prefix.IsValid() && !rule.Prefix.Contains(ip) {
+		return false
+	}
+	if rule.Hostname != "" {
+		if hostname == "" {
+			return false
+		}
+		if suffix, ok := strings.CutPrefix(rule.Hostname, "*"); ok {
+			if !strings.HasSuffix(hostname, suffix) {
+				return false
+			}
+		} else if hostname != rule.Hostname {
+			return false
+		}
+	}
+	if len(rule.Ports) == 0 {
+		return true
+	}
+	for _, portRange := range rule.Ports {
+		if portRange.From <= port && port <= portRange.To {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeHostname(hostname string) string {
+	return strings.TrimSuffix(strings.ToLower(hostname), ".")
+}
+
+// See `isRemoteAddress` in the Snowflake proxy.
+func isLocalAddress(ip netip.Addr) bool {
+	return ip.IsPrivate() ||
+		ip.IsLoopback() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsMulticast() ||
+		ip.IsUnspecified() ||
+		thisNetwork.Contains(ip) ||
+		carrierGradeNAT.Contains(ip)
+}
+
+// "This network", see RFC 1122. Linux connects to 127.0.0.1 for 0.0.0.0.
+var thisNetwork = netip.MustParsePrefix("0.0.0.0/8")
+
+// See RFC 6598.
+var carrierGradeNAT = netip.MustParsePrefix("100.64.0.0/10")
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/WofWca/snowflake-generalized/common"
+)
+
+func TestParseACL(t *testing.T) {
+	acl, err := ParseACL(strings.NewReader(`
+		# A comment.
+		allow tcp 10.0.0.0/8 80,8000-8999
+		deny udp 192.0.2.1
+		allow any *.Example.com.
+		deny any *
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(acl.Rules) != 4 {
+		t.Fatalf("got %v rules, want 4", len(acl.Rules))
+	}
+	rule := acl.Rules[0]
+	if !rule.Allow || rule.Network != "tcp" || rule.Prefix.String() != "10.0.0.0/8" ||
+		len(rule.Ports) != 2 || rule.Ports[1] != (PortRange{8000, 8999}) {
+		t.Errorf("rule 0: %+v", rule)
+	}
+	if rule := acl.Rules[1]; rule.Allow || rule.Prefix.String() != "192.0.2.1/32" {
+		t.Errorf("rule 1: %+v", rule)
+	}
+	if rule := acl.Rules[2]; rule.Network != "" || rule.Hostname != "*.example.com" {
+		t.Errorf("rule 2: %+v", rule)
+	}
+	if rule := acl.Rules[3]; rule.Prefix.IsValid() || rule.Hostname != "" {
+		t.Errorf("rule 3: %+v", rule)
+	}
+
+	for _, line := range []string{
+		"allow tcp",
+		"allow tcp * 80 extra",
+		"permit tcp * 80",
+		"allow icmp * 80",
+		"allow tcp * http",
+		"allow tcp * 70000",
+		"allow tcp * 90-80",
+	} {
+		_, err := ParseACL(strings.NewReader("deny any *.example.com\n" + line))
+		if err == nil || !strings.HasPrefix(err.Error(), "line 2: ") {
+			t.Errorf("%q: got error %v", line, err)
+		}
+	}
+}
+
+func TestACLResolve(t *testing.T) {
+	acl, err := ParseACL(strings.NewReader(`
+		deny tcp 203.0.113.0/24 22
+		allow udp 192.168.1.0/24
+		allow any localhost 8080
+		allow tcp * 80,443
+		deny any 198.51.100.0/24
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		network, address string
+		allowed          bool
+	}{
+		{"tcp", "203.0.113.1:22", false},
+		{"tcp", "203.0.113.1:80", true},
+		{"udp", "203.0.113.1:22", true},
+		{"udp", "192.168.1.1:53", true},
+		{"tcp", "192.168.1.1:53", false},
+		// Not allowed by a rule without an address.
+		{"tcp", "192.168.1.1:80", false},
+		{"tcp", "[::1]:80", false},
+		{"tcp", "169.254.169.254:80", false},
+		{"tcp", "100.64.0.1:80", false},
+		// The first matching rule decides.
+		{"tcp", "198.51.100.1:80", true},
+		{"udp", "198.51.100.1:80", false},
+		// No rule matches.
+		{"udp", "203.0.113.1:53", true},
+		{"udp", "10.0.0.1:53", false},
+		{"tcp", "[::ffff:10.0.0.1]:443", false},
+	} {
+		resolved, err := acl.Resolve(context.Background(), test.network, test.address)
+		if test.allowed {
+			if err != nil {
+				t.Errorf("%v %v: %v", test.network, test.address, err)
+			} else if resolved != test.address {
+				t.Errorf("%v %v: resolved to %v", test.network, test.address, resolved)
+			}
+		} else if !errors.Is(err, common.ErrDestinationForbidden) {
+			t.Errorf("%v %v: got %v, want %v", test.network, test.address, err, common.ErrDestinationForbidden)
+		}
+	}
+
+	if _, err := acl.Resolve(context.Background(), "tcp", "0.1.2.3:443"); !errors.Is(err, common.ErrDestinationForbidden) {
+		t.Errorf("got %v, want %v", err, common.ErrDestinationForbidden)
+	}
+}
+
+// A hostname rule must not allow a local address,
+// whatever the name resolves to.
+func TestACLHostnameToLocalAddress(t *testing.T) {
+	acl, err := ParseACL(strings.NewReader(`
+		allow tcp *.example.com 443
+		allow tcp localhost 8080
+		allow tcp 10.1.0.0/16 443
+		deny any *
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := map[string]string{
+		"public.example.com":    "203.0.113.5",
+		"loopback.example.com":  "127.0.0.1",
+		"loopback6.example.com": "::1",
+		"metadata.example.com":  "169.254.169.254",
+		"private.example.com":   "192.168.1.1",
+		"zero.example.com":      "0.0.0.0",
+		"mapped.example.com":    "::ffff:127.0.0.1",
+		"allowed.example.com":   "10.1.2.3",
+		"localhost":             "127.0.0.1",
+	}
+	acl.lookupNetIP = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		ip, ok := hosts[host]
+		if !ok {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return []netip.Addr{netip.MustParseAddr(ip)}, nil
+	}
+
+	for host, ip := range hosts {
+		port := "443"
+		if host == "localhost" {
+			port = "8080"
+		}
+		resolved, err := acl.Resolve(context.Background(), "tcp", net.JoinHostPort(host, port))
+		switch host {
+		case "public.example.com", "allowed.example.com":
+			if err != nil {
+				t.Errorf("%v: %v", host, err)
+			} else if want := net.JoinHostPort(ip, port); resolved != want {
+				t.Errorf("%v: resolved to %v, want %v", host, resolved, want)
+			}
+		default:
+			if !errors.Is(err, common.ErrDestinationForbidden) {
+				t.Errorf("%v (%v): got %v, want %v", host, ip, err, common.ErrDestinationForbidden)
+			}
+		}
+	}
+}
+
+func TestACLDialer(t *testing.T) {
+	memoryDialer := NewMemoryDialer()
+	for _, address := range []string{"192.0.2.1:7", "192.0.2.2:7"} {
+		serveMemory(t, memoryDialer, "tcp", address, echo)
+	}
+	acl, err := ParseACL(strings.NewReader("deny tcp 192.0.2.2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := NewACLDialer(acl, memoryDialer)
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", "192.0.2.1:7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	checkEcho(t, conn, []byte("hello"))
+
+	if _, err := dialer.DialContext(context.Background(), "tcp", "192.0.2.2:7"); !errors.Is(err, common.ErrDestinationForbidden) {
+		t.Fatalf("got %v, want %v", err, common.ErrDestinationForbidden)
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/ptutil/safelog"
+)
+
+// AdminConfig configures `Server.AdminHandler()`.
+type AdminConfig struct {
+	// Token must be passed in the "Authorization: Bearer <token>" header
+	// of every request. Must not be empty.
+	Token string
+	// UnsafeAddresses disables scrubbing
+	// `SessionInfo.RemoteAddress`, like "unsafe-logging".
+	UnsafeAddresses bool
+}
+
+// AdminHandler returns an HTTP API to inspect and manage the sessions:
+//
+//   - `GET /sessions` returns `Sessions()` as JSON.
+//   - `DELETE /sessions/{id}` does `CloseSession()`.
+//   - `DELETE /sessions/{id}/streams/{stream}` does `CloseStream()`.
+//
+// It's not encrypted, so only serve it on a local address,
+// or behind a reverse proxy with TLS.
+func (s *Server) AdminHandler(config AdminConfig) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		sessions := s.Sessions()
+		if !config.UnsafeAddresses {
+			for i := range sessions {
+				sessions[i].RemoteAddress = string(
+					safelog.Scrub([]byte(sessions[i].RemoteAddress)),
+				)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sessions)
+	})
+	mux.HandleFunc("DELETE /sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid session ID", http.StatusBadRequest)
+			return
+		}
+		writeAdminResult(w, s.CloseSession(id))
+	})
+	mux.HandleFunc(
+		"DELETE /sessions/{id}/streams/{stream}",
+		func(w http.ResponseWriter, r *http.Request) {
+			id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+			if err != nil {
+				http.Error(w, "invalid session ID", http.StatusBadRequest)
+				return
+			}
+			streamID, err := strconv.ParseUint(r.PathValue("stream"), 10, 32)
+			if err != nil {
+				http.Error(w, "invalid stream ID", http.StatusBadRequest)
+				return
+			}
+			writeAdminResult(w, s.CloseStream(id, uint32(streamID)))
+		},
+	)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || config.Token == "" ||
+			subtle.ConstantTimeCompare([]byte(token), []byte(config.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeAdminResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, ErrSessionNotFound), errors.Is(err, ErrStreamNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BalancingStrategy determines which backend a new connection goes to.
+type BalancingStrategy string
+
+const (
+	// Backends are used in turn.
+	RoundRobin BalancingStrategy = "round-robin"
+	// The backend with the fewest open connections is used.
+	LeastConnections BalancingStrategy = "least-connections"
+	// All connections of a Snowflake client go to the same backend,
+	// as long as it's healthy. This is what you want for UDP flows
+	// (e.g. WireGuard), so that the destination sees one peer.
+	// Backends are placed on a hash ring, so adding or removing a backend
+	// only moves the clients of that backend.
+	ConsistentHash BalancingStrategy = "consistent-hash"
+)
+
+// BalancingStrategies lists all the valid `BalancingStrategy` values.
+var BalancingStrategies = []BalancingStrategy{RoundRobin, LeastConnections, ConsistentHash}
+
+// BalancerConfig defines the backends and how to pick one of them.
+type BalancerConfig struct {
+	// Backends are the destination addresses.
+	Backends []string
+	// Network is "tcp" or "udp".
+	Network  string
+	Strategy BalancingStrategy
+	// Dialer is used to connect to the backends. If `nil`, `net.Dialer` is used.
+	Dialer Dialer
+
+	// HealthCheckInterval is how often to check the backends.
+	// A check is a plain connection attempt, so it only tells anything
+	// for TCP. For UDP only the failed dials mark a backend unhealthy.
+	// 0 disables active health checks.
+	HealthCheckInterval time.Duration
+	// HealthCheckTimeout defaults to 5 seconds.
+	HealthCheckTimeout time.Duration
+	// UnhealthyRetryAfter is for how long a backend is skipped after
+	// a failed dial or health check, unless a health check
+	// finds it healthy again sooner. Defaults to 30 seconds.
+	UnhealthyRetryAfter time.Duration
+}
+
+// Balancer distributes destination connections across several backends
+// and fails over to the next backend if one can't be dialed.
+type Balancer struct {
+	config BalancerConfig
+	// Sorted by hash. Only for `ConsistentHash`.
+	ring []ringNode
+
+	mu             sync.Mutex
+	backends       []*backend
+	roundRobinNext int
+
+	stopHealthChecks context.CancelFunc
+}
+
+type backend struct {
+	address string
+	// Protected by `Balancer.mu`.
+	activeConns    int
+	unhealthyUntil time.Time
+}
+
+type ringNode struct {
+	hash         uint64
+	backendIndex int
+}
+
+// How many points each backend gets on the hash ring.
+// More points make the distribution more even.
+const ringPointsPerBackend = 100
+
+// NewBalancer creates a balancer and starts the health checks, if enabled.
+// Call `Close()` to stop them.
+func NewBalancer(config BalancerConfig) (*Balancer, error) {
+	if len(config.Backends) == 0 {
+		return nil, errors.New("no backends")
+	}
+	if !slices.Contains(BalancingStrategies, config.Strategy) {
+		return nil, fmt.Errorf(
+			"unknown balancing strategy %q, must be one of %v",
+			config.Strategy,
+			BalancingStrategies,
+		)
+	}
+	if config.Dialer == nil {
+		config.Dialer = &net.Dialer{}
+	}
+	if config.HealthCheckTimeout == 0 {
+		config.HealthCheckTimeout = 5 * time.Second
+	}
+	if config.UnhealthyRetryAfter == 0 {
+		config.UnhealthyRetryAfter = 30 * time.Second
+	}
+
+	b := &Balancer{config: config}
+	for i, address := range config.Backends {
+		b.backends = append(b.backends, &backend{address: address})
+		for point := 0; point < ringPointsPerBackend; point++ {
+			b.ring = append(b.ring, ringNode{
+				hash:         hashString(address + "#" + strconv.Itoa(point)),
+				backendIndex: i,
+			})
+		}
+	}
+	slices.SortFunc(b.ring, func(a, b ringNode) int {
+		return cmp.Compare(a.hash, b.hash)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b.stopHealthChecks = cancel
+	if config.HealthCheckInterval > 0 {
+		go b.healthCheckLoop(ctx)
+	}
+	return b, nil
+}
+
+// FNV is faster, but distributes similar strings (such as ring points)
+// noticeably unevenly.
+func hashString(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Dial connects to one of the backends.
+// `clientKey` identifies the Snowflake client, for `ConsistentHash`.
+// If a backend can't be dialed, it is marked unhealthy
+// and the next candidate is tried.
+func (b *Balancer) Dial(ctx context.Context, clientKey string) (net.Conn, error) {
+	candidates := b.candidates(clientKey)
+	var errs []error
+	for _, backend := range candidates {
+		b.mu.Lock()
+		backend.activeConns++
+		b.mu.Unlock()
+
+		conn, err := b.config.Dialer.DialContext(ctx, b.config.Network, backend.address)
+		if err == nil {
+			b.markHealthy(backend)
+			return &balancedConn{Conn: conn, balancer: b, backend: backend}, nil
+		}
+
+		b.mu.Lock()
+		backend.activeConns--
+		b.mu.Unlock()
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		log.Printf("Failed to dial backend %v, trying the next one: %v", backend.address, err)
+		b.markUnhealthy(backend)
+		errs = append(errs, err)
+	}
+	return nil, fmt.Errorf("all backends failed: %w", errors.Join(errs...))
+}
+
+// Returns all the backends in the order in which they should be tried:
+// healthy ones first, in the order of the strategy, then the unhealthy ones,
+// in case all of them are unhealthy.
+func (b *Balancer) candidates(clientKey string) []*backend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var ordered []*backend
+	switch b.config.Strategy {
+	case RoundRobin:
+		start := b.roundRobinNext
+		b.roundRobinNext = (b.roundRobinNext + 1) % len(b.backends)
+		for i := range b.backends {
+			ordered = append(ordered, b.backends[(start+i)%len(b.backends)])
+		}
+	case LeastConnections:
+		ordered = slices.Clone(b.backends)
+		slices.SortStableFunc(ordered, func(a, b *backend) int {
+			return a.activeConns - b.activeConns
+		})
+	case ConsistentHash:
+		hash := hashString(clientKey)
+		start, _ := slices.BinarySearchFunc(b.ring, hash, func(n ringNode, h uint64) int {
+			return cmp.Compare(n.hash, h)
+		})
+		seen := make([]bool, len(b.backends))
+		for i := 0; i < len(b.ring) && len(ordered) < len(b.backends); i++ {
+			node := b.ring[(start+i)%len(b.ring)]
+			if !seen[node.backendIndex] {
+				seen[node.backendIndex] = true
+				ordered = append(ordered, b.backends[node.backendIndex])
+			}
+		}
+	}
+
+	now := time.Now()
+	healthy := make([]*backend, 0, len(ordered))
+	var unhealthy []*backend
+	for _, backend := range ordered {
+		if now.Before(backend.unhealthyUntil) {
+			unhealthy = append(unhealthy, backend)
+		} else {
+			healthy = append(healthy, backend)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (b *Balancer) markUnhealthy(backend *backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Now().After(backend.unhealthyUntil) {
+		log.Printf("Backend %v is now unhealthy", backend.address)
+	}
+	backend.unhealthyUntil = time.Now().Add(b.config.UnhealthyRetryAfter)
+}
+
+func (b *Balancer) markHealthy(backend *backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Now().Before(backend.unhealthyUntil) {
+		log.Printf("Backend %v is healthy again", backend.address)
+	}
+	backend.unhealthyUntil = time.Time{}
+}
+
+func (b *Balancer) healthCheckLoop(ctx context.Context) {
+	ticker := time.NewTicker(b.config.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, backend := range b.backends {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				b.checkHealth(ctx, backend)
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (b *Balancer) checkHealth(ctx context.Context, backend *backend) {
+	ctx, cancel := context.WithTimeout(ctx, b.config.HealthCheckTimeout)
+	defer cancel()
+	conn, err := b.config.Dialer.DialContext(ctx, b.config.Network, backend.address)
+	if err != nil {
+		if ctx.Err() == context.Canceled {
+			return
+		}
+		b.markUnhealthy(backend)
+		return
+	}
+	conn.Close()
+	b.markHealthy(backend)
+}
+
+// Close stops the health checks.
+// The connections that have been dialed stay open.
+func (b *Balancer) Close() error {
+	b.stopHealthChecks()
+	return nil
+}
+
+// Keeps track of `backend.activeConns`.
+type balancedConn struct {
+	net.Conn
+	balancer  *Balancer
+	backend   *backend
+	closeOnce sync.Once
+}
+
+func (c *balancedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.balancer.mu.Lock()
+		c.backend.activeConns--
+		c.balancer.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
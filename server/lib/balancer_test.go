@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestBalancer(t *testing.T, config BalancerConfig) *Balancer {
+	t.Helper()
+	if config.Network == "" {
+		config.Network = "tcp"
+	}
+	balancer, err := NewBalancer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { balancer.Close() })
+	return balancer
+}
+
+// Dials with `balancer` and returns the address of the backend.
+// The connection is closed when the test ends.
+func dialBackend(t *testing.T, balancer *Balancer, clientKey string) string {
+	t.Helper()
+	conn, err := balancer.Dial(context.Background(), clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn.(*balancedConn).backend.address
+}
+
+func TestConsistentHash(t *testing.T) {
+	backends := []string{"backend-0:7", "backend-1:7", "backend-2:7", "backend-3:7"}
+	balancer := newTestBalancer(t, BalancerConfig{
+		Backends: backends,
+		Strategy: ConsistentHash,
+	})
+	withoutLast := newTestBalancer(t, BalancerConfig{
+		Backends: backends[:3],
+		Strategy: ConsistentHash,
+	})
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		clientKey := fmt.Sprintf("client-%v", i)
+		address := balancer.candidates(clientKey)[0].address
+		counts[address]++
+		if again := balancer.candidates(clientKey)[0].address; again != address {
+			t.Fatalf("%v went to %v, then to %v", clientKey, address, again)
+		}
+		// Removing a backend must only move its own clients.
+		if other := withoutLast.candidates(clientKey)[0].address; address != backends[3] && other != address {
+			t.Fatalf("%v moved from %v to %v", clientKey, address, other)
+		}
+	}
+	for _, address := range backends {
+		if counts[address] < 100 {
+			t.Errorf("the distribution is too uneven: %v", counts)
+			break
+		}
+	}
+}
+
+func TestBalancerFailover(t *testing.T) {
+	dialer := NewMemoryDialer()
+	serveMemory(t, dialer, "tcp", "backend-1:7", echo)
+	balancer := newTestBalancer(t, BalancerConfig{
+		Backends: []string{"backend-0:7", "backend-1:7"},
+		Strategy: RoundRobin,
+		Dialer:   dialer,
+	})
+
+	// "backend-0:7" isn't listening.
+	if address := dialBackend(t, balancer, ""); address != "backend-1:7" {
+		t.Fatalf("dialed %v", address)
+	}
+	unhealthy := balancer.backends[0]
+	isHealthy := func() bool {
+		balancer.mu.Lock()
+		defer balancer.mu.Unlock()
+		return time.Now().After(unhealthy.unhealthyUntil)
+	}
+	if isHealthy() {
+		t.Fatal("the failed backend hasn't been marked unhealthy")
+	}
+	// It's skipped, even though it's its turn.
+	if address := dialBackend(t, balancer, ""); address != "backend-1:7" {
+		t.Fatalf("dialed %v", address)
+	}
+	balancer.checkHealth(context.Background(), unhealthy)
+	if isHealthy() {
+		t.Fatal("the health check has passed on a backend that isn't listening")
+	}
+
+	serveMemory(t, dialer, "tcp", "backend-0:7", echo)
+	balancer.checkHealth(context.Background(), unhealthy)
+	if !isHealthy() {
+		t.Fatal("the health check has failed on a backend that is listening")
+	}
+	if address := dialBackend(t, balancer, ""); address != "backend-0:7" {
+		t.Fatalf("dialed %v", address)
+	}
+
+	_, err := newTestBalancer(t, BalancerConfig{
+		Backends: []string{"backend-2:7"},
+		Strategy: RoundRobin,
+		Dialer:   dialer,
+	}).Dial(context.Background(), "")
+	if err == nil {
+		t.Fatal("dialed a backend that isn't listening")
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	dialer := NewMemoryDialer()
+	backends := []string{"backend-0:7", "backend-1:7", "backend-2:7"}
+	for _, address := range backends {
+		serveMemory(t, dialer, "tcp", address, echo)
+	}
+	balancer := newTestBalancer(t, BalancerConfig{
+		Backends: backends,
+		Strategy: RoundRobin,
+		Dialer:   dialer,
+	})
+	for i := 0; i < 2*len(backends); i++ {
+		if address := dialBackend(t, balancer, ""); address != backends[i%len(backends)] {
+			t.Fatalf("dial %v went to %v", i, address)
+		}
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	dialer := NewMemoryDialer()
+	backends := []string{"backend-0:7", "backend-1:7"}
+	for _, address := range backends {
+		serveMemory(t, dialer, "tcp", address, echo)
+	}
+	balancer := newTestBalancer(t, BalancerConfig{
+		Backends: backends,
+		Strategy: LeastConnections,
+		Dialer:   dialer,
+	})
+
+	first, err := balancer.Dial(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address := dialBackend(t, balancer, ""); address != backends[1] {
+		t.Fatalf("went to %v, which has more connections", address)
+	}
+	first.Close()
+	// Closing twice must not count twice.
+	first.Close()
+	if address := dialBackend(t, balancer, ""); address != backends[0] {
+		t.Fatalf("went to %v, which has more connections", address)
+	}
+	balancer.mu.Lock()
+	defer balancer.mu.Unlock()
+	for _, backend := range balancer.backends {
+		if backend.activeConns != 1 {
+			t.Errorf("%v has %v connections, want 1", backend.address, backend.activeConns)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"log"
+	"net"
+
+	"github.com/WofWca/snowflake-generalized/common"
+)
+
+type bondEntry struct {
+	bond *common.Bond
+	// Who created the bond. Only the same client may add paths to it,
+	// otherwise anyone who has seen the ID (e.g. a proxy) could receive
+	// its data, and bypass the limits of its user.
+	clientKey string
+	user      *User
+}
+
+// Adds the Snowflake connection to the bond that it's a path of.
+// If that is a new bond, returns it so that it is served
+// like a regular Snowflake connection.
+// Otherwise waits until the path is lost, and returns `nil`.
+// `clientKey` and `user` identify the client, see `ServeConn()`.
+func (s *Server) joinBond(
+	snowflakeConn net.Conn,
+	bondHello *common.BondHello,
+	clientKey string,
+	user *User,
+) *common.Bond {
+	s.mu.Lock()
+	entry, exists := s.bonds[bondHello.ID]
+	var bond *common.Bond
+	switch {
+	case exists && (entry.clientKey != clientKey || entry.user != user):
+		s.mu.Unlock()
+		// Same as for an unknown bond, so as not to reveal that it exists.
+		log.Printf("A different client tried to add a path to bond %v", bondHello.ID)
+		common.RejectBondPath(snowflakeConn)
+		return nil
+	case exists:
+		bond = entry.bond
+	case !bondHello.Join:
+		bond = common.NewBond(bondHello.ID)
+		entry = &bondEntry{bond: bond, clientKey: clientKey, user: user}
+		s.bonds[bondHello.ID] = entry
+		go func() {
+			<-bond.Done()
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.bonds[bondHello.ID] == entry {
+				delete(s.bonds, bondHello.ID)
+			}
+		}()
+	}
+	s.mu.Unlock()
+
+	if bond == nil {
+		log.Printf("The client tried to add a path to an unknown bond %v", bondHello.ID)
+		common.RejectBondPath(snowflakeConn)
+		return nil
+	}
+	pathDone, err := bond.AddPath(snowflakeConn)
+	if err != nil {
+		log.Printf("Failed to add a path to bond %v: %v", bondHello.ID, err)
+		common.RejectBondPath(snowflakeConn)
+		return nil
+	}
+	if !exists {
+		log.Printf("New bond %v", bondHello.ID)
+		return bond
+	}
+
+	log.Printf("New path for bond %v, %v paths now", bondHello.ID, bond.PathCount())
+	<-pathDone
+	log.Printf("Lost a path of bond %v, %v paths left", bondHello.ID, bond.PathCount())
+	return nil
+}
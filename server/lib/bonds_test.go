@@ -0,0 +1,132 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/WofWca/snowflake-generalized/common"
+	"github.com/xtaci/smux"
+)
+
+var testBondUsers = []User{
+	{Name: "team-a", Token: "token-a"},
+	{Name: "team-b", Token: "token-b"},
+}
+
+// Connects a path of the bond, as the client with the ID and the token.
+func connectBondPath(
+	t *testing.T,
+	connect func() net.Conn,
+	bondHello *common.BondHello,
+	clientID string,
+	token string,
+) (net.Conn, *common.HandshakeResult) {
+	t.Helper()
+	conn := connect()
+	hello := common.NewHello()
+	hello.ClientID = clientID
+	hello.Token = token
+	hello.Bond = bondHello
+	result, err := common.ClientHandshake(conn, hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.HasFeature(common.FeatureBonding) {
+		t.Fatalf("%v not negotiated", common.FeatureBonding)
+	}
+	return conn, result
+}
+
+// Checks that the server rejects the path, i.e. closes it
+// instead of keeping it as a path of the bond.
+func checkBondPathRejected(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("the path has not been rejected: %v", err)
+	}
+}
+
+// Creates a bond as client "owner" of user "team-a",
+// and returns a stream in it that goes to the echo destination.
+func newOwnedBond(
+	t *testing.T,
+	connect func() net.Conn,
+) (*common.Bond, net.Conn, *smux.Stream) {
+	t.Helper()
+	bondHello := &common.BondHello{ID: common.NewBondID()}
+	conn, result := connectBondPath(t, connect, bondHello, "owner", "token-a")
+	bond := common.NewBond(bondHello.ID)
+	t.Cleanup(func() { bond.Close() })
+	if _, err := bond.AddPath(conn); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := newTestMuxSession(t, bond, result.SmuxVersion).OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stream.Close() })
+	checkEcho(t, stream, []byte("hello"))
+	return bond, conn, stream
+}
+
+func TestBondJoinByAnotherClient(t *testing.T) {
+	connect := newTestServer(t, Config{DestinationProtocol: "tcp", Users: testBondUsers})
+	bond, _, stream := newOwnedBond(t, connect)
+	joinHello := &common.BondHello{ID: bond.ID(), Join: true}
+
+	t.Run("different client ID", func(t *testing.T) {
+		conn, _ := connectBondPath(t, connect, joinHello, "intruder", "token-a")
+		checkBondPathRejected(t, conn)
+	})
+	t.Run("different user", func(t *testing.T) {
+		conn, _ := connectBondPath(t, connect, joinHello, "owner", "token-b")
+		checkBondPathRejected(t, conn)
+	})
+
+	conn, _ := connectBondPath(t, connect, joinHello, "owner", "token-a")
+	if _, err := bond.AddPath(conn); err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, stream, []byte("through both paths"))
+}
+
+// `common.Bond` with a single path, which is what `Resumable` is.
+func TestResumeByAnotherClient(t *testing.T) {
+	connect := newTestServer(t, Config{
+		DestinationProtocol: "tcp",
+		SingleConnMode:      true,
+		Users:               testBondUsers,
+	})
+	bondHello := &common.BondHello{ID: common.NewBondID()}
+	conn, _ := connectBondPath(t, connect, bondHello, "owner", "token-a")
+	bond := common.NewBond(bondHello.ID)
+	defer bond.Close()
+	if _, err := bond.AddPath(conn); err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, bond, []byte("hello"))
+
+	// Lose the proxy.
+	conn.Close()
+	resumeHello := &common.BondHello{ID: bondHello.ID, Join: true}
+	for _, test := range []struct {
+		name, clientID, token string
+	}{
+		{"different client ID", "intruder", "token-a"},
+		{"different token", "owner", "token-b"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conn, _ := connectBondPath(t, connect, resumeHello, test.clientID, test.token)
+			checkBondPathRejected(t, conn)
+		})
+	}
+
+	conn, _ = connectBondPath(t, connect, resumeHello, "owner", "token-a")
+	if _, err := bond.AddPath(conn); err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, bond, []byte("resumed"))
+}
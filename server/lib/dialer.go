@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// Dialer connects to the destination.
+// `net.Dialer` implements it and is used by default.
+//
+// See also `NewBoundDialer`, `NewProxyDialer`, `NewACLDialer`, `MemoryDialer`.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// boundDialer makes connections from a specific local address
+// and / or network interface.
+type boundDialer struct {
+	sourceIP  net.IP
+	ifaceName string
+}
+
+// NewBoundDialer returns a `Dialer` that makes connections
+// from the `sourceIP` local address and / or
+// through the `ifaceName` network interface.
+// Either may be empty.
+//
+// Binding to an interface is only supported on Linux
+// (see `SO_BINDTODEVICE` in socket(7)) and may require `CAP_NET_RAW`.
+func NewBoundDialer(sourceIP string, ifaceName string) (Dialer, error) {
+	d := &boundDialer{ifaceName: ifaceName}
+	if sourceIP != "" {
+		d.sourceIP = net.ParseIP(sourceIP)
+		if d.sourceIP == nil {
+			return nil, fmt.Errorf("invalid source IP address %q", sourceIP)
+		}
+	}
+	if ifaceName != "" {
+		if err := checkBindToDeviceSupported(); err != nil {
+			return nil, err
+		}
+		if _, err := net.InterfaceByName(ifaceName); err != nil {
+			return nil, fmt.Errorf("network interface %q: %w", ifaceName, err)
+		}
+	}
+	return d, nil
+}
+
+func (d *boundDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := net.Dialer{}
+	if d.sourceIP != nil {
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+			dialer.LocalAddr = &net.TCPAddr{IP: d.sourceIP}
+		case "udp", "udp4", "udp6":
+			dialer.LocalAddr = &net.UDPAddr{IP: d.sourceIP}
+		default:
+			return nil, fmt.Errorf("unsupported network %q", network)
+		}
+	}
+	if d.ifaceName != "" {
+		dialer.Control = bindToDeviceControl(d.ifaceName)
+	}
+	return dialer.DialContext(ctx, network, address)
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"syscall"
+)
+
+func checkBindToDeviceSupported() error {
+	return nil
+}
+
+func bindToDeviceControl(ifaceName string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptString(
+				int(fd),
+				syscall.SOL_SOCKET,
+				syscall.SO_BINDTODEVICE,
+				ifaceName,
+			)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"syscall"
+)
+
+func checkBindToDeviceSupported() error {
+	return errors.New("binding to a network interface is only supported on Linux")
+}
+
+func bindToDeviceControl(ifaceName string) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
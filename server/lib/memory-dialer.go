@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// MemoryDialer is a `Dialer` that connects to in-memory listeners
+// created with `MemoryDialer.Listen()`, using `net.Pipe()`.
+// It is useful for tests.
+type MemoryDialer struct {
+	mu        sync.Mutex
+	listeners map[memoryAddr]*memoryListener
+}
+
+// NewMemoryDialer creates a `MemoryDialer` without any listeners.
+func NewMemoryDialer() *MemoryDialer {
+	return &MemoryDialer{
+		listeners: make(map[memoryAddr]*memoryListener),
+	}
+}
+
+// Listen creates a listener that accepts the connections
+// that are made with `DialContext(ctx, network, address)`.
+func (d *MemoryDialer) Listen(network, address string) (net.Listener, error) {
+	addr := memoryAddr{network, address}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.listeners[addr]; ok {
+		return nil, fmt.Errorf("address %v %q is already in use", network, address)
+	}
+	ln := &memoryListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+		dialer: d,
+	}
+	d.listeners[addr] = ln
+	return ln, nil
+}
+
+func (d *MemoryDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	ln, ok := d.listeners[memoryAddr{network, address}]
+	d.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("dial %v %q: connection refused", network, address)
+	}
+
+	clientConn, serverConn := net.Pipe()
+	select {
+	case ln.conns <- serverConn:
+		return clientConn, nil
+	case <-ln.closed:
+		return nil, fmt.Errorf("dial %v %q: connection refused", network, address)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type memoryAddr struct {
+	network string
+	address string
+}
+
+func (a memoryAddr) Network() string { return a.network }
+func (a memoryAddr) String() string  { return a.address }
+
+type memoryListener struct {
+	addr      memoryAddr
+	conns     chan net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+	dialer    *MemoryDialer
+}
+
+func (ln *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.conns:
+		return conn, nil
+	case <-ln.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *memoryListener) Close() error {
+	err := errors.New("listener already closed")
+	ln.closeOnce.Do(func() {
+		close(ln.closed)
+		ln.dialer.mu.Lock()
+		delete(ln.dialer.listeners, ln.addr)
+		ln.dialer.mu.Unlock()
+		err = nil
+	})
+	return err
+}
+
+func (ln *memoryListener) Addr() net.Addr {
+	return ln.addr
+}
@@ -0,0 +1,368 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// NewProxyDialer returns a `Dialer` that connects to the destination
+// through an upstream proxy.
+// `proxyURL` is one of
+//
+//   - socks5://[user:password@]host:port
+//   - http://[user:password@]host:port
+//   - https://[user:password@]host:port
+//
+// The connections to the proxy itself are made with `forward`.
+//
+// UDP is only supported by SOCKS5 proxies, with the UDP ASSOCIATE command.
+// HTTP proxies only support TCP.
+func NewProxyDialer(proxyURL *url.URL, forward Dialer) (Dialer, error) {
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+	var username, password string
+	if proxyURL.User != nil {
+		username = proxyURL.User.Username()
+		password, _ = proxyURL.User.Password()
+	}
+
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		return &socks5Dialer{
+			proxyAddr: hostPortWithDefault(proxyURL, "1080"),
+			username:  username,
+			password:  password,
+			forward:   forward,
+		}, nil
+	case "http", "https":
+		defaultPort := "80"
+		if proxyURL.Scheme == "https" {
+			defaultPort = "443"
+		}
+		return &httpProxyDialer{
+			proxyAddr:     hostPortWithDefault(proxyURL, defaultPort),
+			useTLS:        proxyURL.Scheme == "https",
+			tlsServerName: proxyURL.Hostname(),
+			username:      username,
+			password:      password,
+			forward:       forward,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+}
+
+func hostPortWithDefault(u *url.URL, defaultPort string) string {
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// Makes `conn` obey the deadline and the cancelation of `ctx`
+// until the returned function is called.
+func bindConnToContext(ctx context.Context, conn net.Conn) (stop func()) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stopAfterFunc := context.AfterFunc(ctx, func() {
+		// Unblock pending reads and writes.
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	return func() {
+		stopAfterFunc()
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+// See RFC 1928 and RFC 1929.
+type socks5Dialer struct {
+	proxyAddr string
+	username  string
+	password  string
+	forward   Dialer
+}
+
+const (
+	socks5Version = 5
+
+	socks5AuthNone             = 0
+	socks5AuthUsernamePassword = 2
+	socks5AuthNoAcceptable     = 0xff
+
+	socks5CmdConnect      = 1
+	socks5CmdUDPAssociate = 3
+
+	socks5AddrIPv4   = 1
+	socks5AddrDomain = 3
+	socks5AddrIPv6   = 4
+)
+
+var socks5ReplyMessages = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+func (d *socks5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	case "udp", "udp4", "udp6":
+		return d.dialUDP(ctx, address)
+	default:
+		return nil, fmt.Errorf("SOCKS5 proxy dialer: unsupported network %q", network)
+	}
+
+	conn, err := d.forward.DialContext(ctx, "tcp", d.proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the SOCKS5 proxy: %w", err)
+	}
+	stop := bindConnToContext(ctx, conn)
+	defer stop()
+
+	if err := d.negotiate(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := d.request(conn, socks5CmdConnect, address); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Performs the method negotiation and the authentication.
+func (d *socks5Dialer) negotiate(conn net.Conn) error {
+	greeting := []byte{socks5Version, 1, socks5AuthNone}
+	if d.username != "" {
+		greeting = []byte{socks5Version, 2, socks5AuthNone, socks5AuthUsernamePassword}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version %v", reply[0])
+	}
+
+	switch reply[1] {
+	case socks5AuthNone:
+		return nil
+	case socks5AuthUsernamePassword:
+		if d.username == "" {
+			return errors.New("the SOCKS5 proxy requires authentication")
+		}
+		if len(d.username) > 255 || len(d.password) > 255 {
+			return errors.New("SOCKS5 username or password is too long")
+		}
+		msg := []byte{1, byte(len(d.username))}
+		msg = append(msg, d.username...)
+		msg = append(msg, byte(len(d.password)))
+		msg = append(msg, d.password...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("SOCKS5 authentication failed")
+		}
+		return nil
+	case socks5AuthNoAcceptable:
+		return errors.New("the SOCKS5 proxy did not accept any authentication method")
+	default:
+		return fmt.Errorf("the SOCKS5 proxy chose an unexpected authentication method %v", reply[1])
+	}
+}
+
+// Sends a request and returns the address from the reply.
+func (d *socks5Dialer) request(conn net.Conn, cmd byte, address string) (string, error) {
+	msg := []byte{socks5Version, cmd, 0}
+	msg, err := appendSocks5Addr(msg, address)
+	if err != nil {
+		return "", err
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return "", err
+	}
+
+	var header [3]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unexpected SOCKS version %v", header[0])
+	}
+	if header[1] != 0 {
+		message, ok := socks5ReplyMessages[header[1]]
+		if !ok {
+			message = "unknown error " + strconv.Itoa(int(header[1]))
+		}
+		return "", fmt.Errorf("SOCKS5 proxy: %v", message)
+	}
+	return readSocks5Addr(conn)
+}
+
+func appendSocks5Addr(b []byte, address string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, socks5AddrIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, socks5AddrIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name is too long: %q", host)
+		}
+		b = append(b, socks5AddrDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+func readSocks5Addr(r io.Reader) (string, error) {
+	var addrType [1]byte
+	if _, err := io.ReadFull(r, addrType[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch addrType[0] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if addrType[0] == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unknown SOCKS5 address type %v", addrType[0])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// Uses the CONNECT method, see RFC 9110, section 9.3.6.
+type httpProxyDialer struct {
+	proxyAddr     string
+	useTLS        bool
+	tlsServerName string
+	username      string
+	password      string
+	forward       Dialer
+}
+
+func (d *httpProxyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("HTTP proxy dialer: unsupported network %q", network)
+	}
+
+	conn, err := d.forward.DialContext(ctx, "tcp", d.proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the HTTP proxy: %w", err)
+	}
+	if d.useTLS {
+		conn = tls.Client(conn, &tls.Config{ServerName: d.tlsServerName})
+	}
+	stop := bindConnToContext(ctx, conn)
+	defer stop()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if d.username != "" {
+		credentials := base64.StdEncoding.EncodeToString(
+			[]byte(d.username + ":" + d.password),
+		)
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy: %v", resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		// The destination has already sent something.
+		buffered, _ := br.Peek(br.Buffered())
+		return &bufferedConn{Conn: conn, buffered: buffered}, nil
+	}
+	return conn, nil
+}
+
+// Yields `buffered` before reading from `Conn`.
+type bufferedConn struct {
+	net.Conn
+	buffered []byte
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	if len(c.buffered) > 0 {
+		n := copy(b, c.buffered)
+		c.buffered = c.buffered[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
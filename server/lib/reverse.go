@@ -0,0 +1,118 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net"
+	"slices"
+
+	"github.com/WofWca/snowflake-generalized/common"
+	"github.com/xtaci/smux"
+)
+
+// ErrNoReverseClient means that no connected client
+// accepts reverse connections, see `ServeReverse()`.
+var ErrNoReverseClient = errors.New("no client accepts reverse connections")
+
+// ServeReverse accepts connections from `ln` and forwards each of them
+// to a client, which forwards it to its local address, like `ssh -R`.
+// See `common.FeatureReverse`. Requires `Config.Reverse`.
+//
+// The connections go to the client that connected last,
+// out of the clients of `Config.ReverseUser` if there are `Config.Users`.
+// If no such client is connected, they are closed.
+// Keep in mind that without `Config.Users` any client
+// that can connect to the server can receive them.
+// It returns when `ln.Accept()` fails or the server is closed.
+func (s *Server) ServeReverse(ln net.Listener) error {
+	if !s.config.Reverse {
+		return errors.New("ServeReverse() requires Reverse")
+	}
+	s.mu.Lock()
+	select {
+	case <-s.ctx.Done():
+		s.mu.Unlock()
+		return ErrServerClosed
+	default:
+	}
+	s.listeners[ln] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, ln)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-s.ctx.Done():
+				return ErrServerClosed
+			default:
+			}
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				continue
+			}
+			log.Printf("Failed to accept reverse connection: %s", err)
+			return err
+		}
+		go s.forwardReverse(conn)
+	}
+}
+
+func (s *Server) forwardReverse(conn net.Conn) {
+	defer conn.Close()
+	stream, err := s.openReverseStream()
+	if err != nil {
+		log.Printf("Failed to forward reverse connection from %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+	defer stream.Close()
+	log.Printf(
+		"Forwarding reverse connection from %v to the client (stream %v)",
+		conn.RemoteAddr(),
+		stream.ID(),
+	)
+	common.CopyLoop(stream, conn, s.ctx.Done())
+	log.Printf("Reverse connection ended %v (stream %v)", conn.RemoteAddr(), stream.ID())
+}
+
+// Opens a stream in the most recently established reverse session,
+// falling back to the older ones.
+func (s *Server) openReverseStream() (*smux.Stream, error) {
+	s.mu.Lock()
+	sessions := slices.Clone(s.reverseSessions)
+	s.mu.Unlock()
+	for i := len(sessions) - 1; i >= 0; i-- {
+		stream, err := sessions[i].OpenStream()
+		if err == nil {
+			return stream, nil
+		}
+	}
+	return nil, ErrNoReverseClient
+}
+
+// Whether the client of `user` (`nil` if there are no `Config.Users`)
+// may receive the connections accepted by `ServeReverse()`.
+func (s *Server) mayReceiveReverse(user *User) bool {
+	if s.users == nil {
+		return true
+	}
+	return user != nil && s.config.ReverseUser != "" && user.Name == s.config.ReverseUser
+}
+
+func (s *Server) addReverseSession(muxSession *smux.Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reverseSessions = append(s.reverseSessions, muxSession)
+}
+
+func (s *Server) removeReverseSession(muxSession *smux.Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reverseSessions = slices.DeleteFunc(
+		s.reverseSessions,
+		func(other *smux.Session) bool { return other == muxSession },
+	)
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/WofWca/snowflake-generalized/common"
+	"github.com/xtaci/smux"
+)
+
+// Connects a client of the user that accepts reverse connections,
+// and returns its session once the server is serving it.
+func connectReverseClient(t *testing.T, connect func() net.Conn, token string) *smux.Session {
+	t.Helper()
+	conn := connect()
+	hello := common.NewHello()
+	hello.Token = token
+	result, err := common.ClientHandshake(conn, hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.HasFeature(common.FeatureReverse) {
+		t.Fatalf("%v not negotiated", common.FeatureReverse)
+	}
+	session := newTestMuxSession(t, conn, result.SmuxVersion)
+	// The server has decided about the reverse connections
+	// by the time it accepts streams.
+	checkMuxEcho(t, session)
+	return session
+}
+
+// Tells whether `session` gets the reverse connection, and if so,
+// checks that the data goes through.
+func receivesReverse(t *testing.T, session *smux.Session, reverseConn net.Conn) bool {
+	t.Helper()
+	session.SetDeadline(time.Now().Add(time.Second))
+	defer session.SetDeadline(time.Time{})
+	stream, err := session.AcceptStream()
+	if err != nil {
+		return false
+	}
+	defer stream.Close()
+	reverseConn.Write([]byte("hello"))
+	got := make([]byte, len("hello"))
+	stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(stream, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte("hello")) {
+		t.Fatalf("got %q", got)
+	}
+	return true
+}
+
+func TestReverseUser(t *testing.T) {
+	users := []User{
+		{Name: "team-a", Token: "token-a"},
+		{Name: "team-b", Token: "token-b"},
+	}
+	for _, test := range []struct {
+		name        string
+		reverseUser string
+		wantA       bool
+	}{
+		{"reverse user", "team-a", true},
+		{"no reverse user", "", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dialer := NewMemoryDialer()
+			serveMemory(t, dialer, "tcp", testDestination, echo)
+			server := NewServer(Config{
+				DestinationProtocol: "tcp",
+				DestinationAddress:  testDestination,
+				Dialer:              dialer,
+				Users:               users,
+				Reverse:             true,
+				ReverseUser:         test.reverseUser,
+			})
+			defer server.Close()
+			reverseListener, err := dialer.Listen("tcp", "reverse:80")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go server.ServeReverse(reverseListener)
+
+			connect := connectToServer(t, server)
+			a := connectReverseClient(t, connect, "token-a")
+			// It connected last, so it would get them if it was allowed to.
+			b := connectReverseClient(t, connect, "token-b")
+
+			reverseConn, err := dialer.DialContext(context.Background(), "tcp", "reverse:80")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reverseConn.Close()
+			if receivesReverse(t, b, reverseConn) {
+				t.Fatal("another user has received the reverse connection")
+			}
+			if got := receivesReverse(t, a, reverseConn); got != test.wantA {
+				t.Fatalf("the reverse user received it: %v, want %v", got, test.wantA)
+			}
+		})
+	}
+}
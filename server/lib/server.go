@@ -0,0 +1,496 @@
+/*
+Package server implements the Snowflake Generalized server,
+i.e. the part that accepts Snowflake client connections
+and forwards them to the destination.
+
+	s := server.NewServer(server.Config{
+		DestinationProtocol: "tcp",
+		DestinationAddress:  "localhost:1080",
+	})
+	defer s.Close()
+	// `ln` is usually a `snowflakeServer.SnowflakeListener`.
+	err := s.Serve(ln)
+*/
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/WofWca/snowflake-generalized/common"
+	"github.com/xtaci/smux"
+	snowflakeServer "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/server/lib"
+)
+
+// Config defines where the server forwards client connections.
+type Config struct {
+	// DestinationProtocol is what type of packets to send to the destination,
+	// i.e. what protocol the target application (WireGuard, SOCKS server)
+	// is using, "udp" or "tcp".
+	DestinationProtocol string
+	// DestinationAddress is the address to forward client connections to.
+	// This can also be a remote address.
+	DestinationAddress string
+
+	// SingleConnMode means that each Snowflake client connection
+	// makes only a single connection to the destination, without multiplexing.
+	// The value must be the same for both the server and the client.
+	SingleConnMode bool
+
+	// Dialer is used to connect to the destination.
+	// If `nil`, `net.Dialer` is used.
+	Dialer Dialer
+	// Balancer, if set, picks one of several destinations
+	// for every connection, and `DestinationAddress` and `Dialer`
+	// are not used.
+	Balancer *Balancer
+
+	// AllowClientDestinations lets clients choose the destination
+	// of every connection (e.g. the client in TUN mode),
+	// see `common.FeatureDestinations`. Such connections are made
+	// with `Dialer`. Only in mux mode.
+	// This effectively makes the server an open proxy for its clients.
+	AllowClientDestinations bool
+	// DestinationACL decides which destinations the clients may choose
+	// with `AllowClientDestinations`. If `nil`, an empty `ACL` is used,
+	// i.e. only local addresses are forbidden.
+	// `DestinationAddress` and `DNSResolver` are not checked,
+	// unless `Dialer` is wrapped with `NewACLDialer()`.
+	DestinationACL *ACL
+
+	// DNSResolver, if set, is the address ("host:port") of the DNS server
+	// that the clients' DNS queries are forwarded to, over TCP,
+	// see `common.FeatureDNS`. It is connected to with `Dialer`.
+	// Only in mux mode.
+	DNSResolver string
+
+	// Users, if not empty, are the only ones who may connect,
+	// and their limits are enforced. The clients identify themselves
+	// with `common.Hello.Token`.
+	Users []User
+	// Accounting, if set, records how much every user has transferred,
+	// and enforces `User.DailyBytes` and `User.MonthlyBytes`.
+	// It is not closed by `Server.Close()`.
+	Accounting *Accounting
+
+	// Reverse lets the clients that offer `common.FeatureReverse`
+	// receive the connections accepted by `ServeReverse()`.
+	// Only in mux mode.
+	Reverse bool
+	// ReverseUser is the name of the `User` whose clients receive
+	// the reverse connections, so that one user can't take over
+	// the connections meant for another. With `Users`, no client
+	// receives them without it. Without `Users`, any client does.
+	ReverseUser string
+}
+
+// Server forwards Snowflake client connections to the destination.
+type Server struct {
+	config Config
+	hello  *common.Hello
+
+	// Canceled on `Close()`.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	// By `BondHello.ID`.
+	bonds map[string]*bondEntry
+	// The sessions of the clients that use `common.FeatureReverse`,
+	// in the order they were established.
+	reverseSessions []*smux.Session
+
+	// For clients that don't send `Hello.ClientID`.
+	nextAnonymousClientKey atomic.Uint64
+
+	// `nil` if there are no `Config.Users`.
+	users *userLimiter
+
+	// Protected by `mu`.
+	sessions      map[uint64]*sessionEntry
+	nextSessionID atomic.Uint64
+}
+
+// NewServer creates a server. Call `Serve()` to start serving connections.
+func NewServer(config Config) *Server {
+	if config.Dialer == nil {
+		config.Dialer = &net.Dialer{}
+	}
+	if config.DestinationACL == nil {
+		config.DestinationACL = &ACL{}
+	}
+	hello := common.NewHello()
+	if config.DestinationProtocol != "udp" {
+		hello.RemoveFeature(common.FeatureDatagramFraming)
+	}
+	if !config.AllowClientDestinations || config.SingleConnMode {
+		hello.RemoveFeature(common.FeatureDestinations)
+	}
+	if config.DNSResolver == "" || config.SingleConnMode {
+		hello.RemoveFeature(common.FeatureDNS)
+	}
+	if !config.Reverse || config.SingleConnMode {
+		hello.RemoveFeature(common.FeatureReverse)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		config:    config,
+		hello:     hello,
+		ctx:       ctx,
+		cancel:    cancel,
+		listeners: make(map[net.Listener]struct{}),
+		bonds:     make(map[string]*bondEntry),
+		sessions:  make(map[uint64]*sessionEntry),
+	}
+	if len(config.Users) > 0 {
+		s.users = newUserLimiter(config.Users, config.Accounting)
+	}
+	return s
+}
+
+// ErrServerClosed is returned by `Serve()` after `Close()`.
+var ErrServerClosed = errors.New("server closed")
+
+// Serve accepts Snowflake client connections from `ln`
+// and serves each of them in a new goroutine.
+// It returns when `ln.Accept()` fails or the server is closed.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	select {
+	case <-s.ctx.Done():
+		s.mu.Unlock()
+		return ErrServerClosed
+	default:
+	}
+	s.listeners[ln] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, ln)
+		s.mu.Unlock()
+	}()
+
+	for {
+		clientConn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-s.ctx.Done():
+				return ErrServerClosed
+			default:
+			}
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				continue
+			}
+			log.Printf("Failed to accept proxy connection: %s", err)
+			// The original Snowflake server also stops on this:
+			// https://gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/-/blob/6d2011ded71dc53662fa0f256fbf9c3036c474a4/server/server.go#L99-111
+			return err
+		}
+		log.Printf(
+			"Got Snowflake client connection! Forwarding to %v \"%v\"",
+			s.config.DestinationProtocol,
+			s.config.DestinationAddress,
+		)
+
+		go s.ServeConn(clientConn)
+	}
+}
+
+// ServeConn performs the handshake and serves a single
+// Snowflake client connection in the configured mode.
+// Closes the connection when it finishes serving it.
+func (s *Server) ServeConn(snowflakeConn net.Conn) {
+	defer snowflakeConn.Close()
+	stopClosingOnShutdown := context.AfterFunc(s.ctx, func() {
+		snowflakeConn.Close()
+	})
+	defer stopClosingOnShutdown()
+
+	var user *User
+	var checkClient func(*common.Hello) error
+	if s.users != nil {
+		checkClient = func(clientHello *common.Hello) error {
+			var err error
+			user, err = s.users.authenticate(clientHello.Token)
+			return err
+		}
+	}
+	var firstByteTimeout time.Duration
+	if s.config.SingleConnMode {
+		firstByteTimeout = common.SingleConnFirstByteTimeout
+	}
+	conn, handshakeResult, err := common.ServerHandshake(
+		snowflakeConn,
+		s.hello,
+		checkClient,
+		firstByteTimeout,
+	)
+	if err != nil {
+		log.Print("Handshake failed: ", err)
+		return
+	}
+	common.LogHandshakeResult("client", handshakeResult)
+	if s.users != nil && user == nil {
+		log.Print("Rejected a client that didn't perform the handshake, because users are configured")
+		return
+	}
+	if user != nil {
+		log.Printf("The client is user %q", user.Name)
+	}
+	clientKey := s.clientKey(handshakeResult)
+
+	if handshakeResult.HasFeature(common.FeatureBonding) &&
+		handshakeResult.Peer.Bond != nil {
+		bond := s.joinBond(conn, handshakeResult.Peer.Bond, clientKey, user)
+		if bond == nil {
+			return
+		}
+		defer bond.Close()
+		conn = bond
+	}
+	session, conn := s.addSession(snowflakeConn.RemoteAddr(), conn, clientKey, user)
+	defer s.removeSession(session)
+
+	if s.config.SingleConnMode {
+		if handshakeResult.HasFeature(common.FeatureDatagramFraming) {
+			conn = common.NewDatagramConn(conn)
+		}
+		s.serveSnowflakeConnectionInSingleConnMode(conn, clientKey, user, session)
+	} else {
+		s.serveSnowflakeConnectionInMuxMode(conn, handshakeResult, clientKey, user, session)
+	}
+}
+
+// Returns what identifies the Snowflake client.
+// Connections of the same client (e.g. after it switches proxies)
+// have the same key, if the client supports `Hello.ClientID`.
+func (s *Server) clientKey(handshakeResult *common.HandshakeResult) string {
+	if handshakeResult.Peer != nil && handshakeResult.Peer.ClientID != "" {
+		return handshakeResult.Peer.ClientID
+	}
+	return "anonymous-" + strconv.FormatUint(s.nextAnonymousClientKey.Add(1), 10)
+}
+
+func (s *Server) serveSnowflakeConnectionInMuxMode(
+	snowflakeConn net.Conn,
+	handshakeResult *common.HandshakeResult,
+	clientKey string,
+	user *User,
+	session *sessionEntry,
+) {
+	smuxConfig := smux.DefaultConfig()
+	smuxConfig.Version = handshakeResult.SmuxVersion
+	// Let's not close the connection on our own, and let Snowflake handle that.
+	smuxConfig.KeepAliveDisabled = true
+	// See https://gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/-/merge_requests/48
+	// and the similar line in client/lib/client.go
+	smuxConfig.MaxStreamBuffer = snowflakeServer.StreamSize
+
+	muxSession, err := smux.Server(snowflakeConn, smuxConfig)
+	if err != nil {
+		log.Print("Mux session open error", err)
+		return
+	}
+	defer muxSession.Close()
+
+	if handshakeResult.HasFeature(common.FeatureReverse) {
+		if s.mayReceiveReverse(user) {
+			s.addReverseSession(muxSession)
+			defer s.removeReverseSession(muxSession)
+		} else {
+			log.Printf("User %q may not receive reverse connections", user.Name)
+		}
+	}
+
+	for {
+		stream, err := muxSession.AcceptStream()
+		if err != nil {
+			// Otherwise it's a regular connection close
+			// TODO or is it? There is `ErrTimeout`?
+			if err != io.ErrClosedPipe {
+				log.Print("AcceptStream error", err)
+			}
+			return
+		}
+		log.Print("New stream!", stream.ID())
+
+		go func() {
+			if user != nil {
+				release, err := s.users.startStream(user)
+				if err != nil {
+					log.Printf("Rejected a connection of user %q: %v", user.Name, err)
+					stream.Close()
+					return
+				}
+				defer release()
+			}
+
+			var clientConn net.Conn = stream
+			var destinationConn net.Conn
+			var err error
+			streamType := common.StreamTypeConnection
+			if handshakeResult.HasFeature(common.FeatureDNS) {
+				stream.SetReadDeadline(time.Now().Add(common.HandshakeTimeout))
+				streamType, err = common.ReadStreamType(stream)
+				stream.SetReadDeadline(time.Time{})
+				if err != nil {
+					log.Print("Failed to read the stream type: ", err)
+					stream.Close()
+					return
+				}
+			}
+			if streamType == common.StreamTypeDNS {
+				destinationConn, err = s.config.Dialer.DialContext(
+					s.ctx,
+					"tcp",
+					s.config.DNSResolver,
+				)
+			} else if handshakeResult.HasFeature(common.FeatureDestinations) {
+				clientConn, destinationConn, err = s.dialRequestedDestination(stream)
+			} else {
+				if handshakeResult.HasFeature(common.FeatureDatagramFraming) {
+					clientConn = common.NewDatagramConn(stream)
+				}
+				destinationConn, err = s.dialDestination(clientKey)
+			}
+			defer clientConn.Close()
+			if err != nil {
+				log.Print("Failed to dial destination address", err)
+				// Hmm should we also snowflakeConn.Close()
+				return
+			}
+			defer destinationConn.Close()
+			if user != nil {
+				clientConn = s.users.meter(user, clientConn)
+			}
+			clientConn = s.addStream(session, stream.ID(), clientConn, destinationConn)
+			defer s.removeStream(session, stream.ID())
+
+			log.Printf(
+				"Opened new connection to %v for stream %v!",
+				destinationConn.RemoteAddr().String(),
+				stream.ID(),
+			)
+
+			common.CopyLoop(clientConn, destinationConn, s.ctx.Done())
+			log.Printf(
+				"Connection ended %v (stream %v)",
+				destinationConn.RemoteAddr().String(),
+				stream.ID(),
+			)
+		}()
+	}
+}
+
+func (s *Server) serveSnowflakeConnectionInSingleConnMode(
+	snowflakeConn net.Conn,
+	clientKey string,
+	user *User,
+	session *sessionEntry,
+) {
+	if user != nil {
+		release, err := s.users.startStream(user)
+		if err != nil {
+			log.Printf("Rejected a connection of user %q: %v", user.Name, err)
+			return
+		}
+		defer release()
+		snowflakeConn = s.users.meter(user, snowflakeConn)
+	}
+
+	destinationConn, err := s.dialDestination(clientKey)
+	if err != nil {
+		log.Print("Failed to dial destination address", err)
+		return
+	}
+	defer destinationConn.Close()
+	snowflakeConn = s.addStream(session, 0, snowflakeConn, destinationConn)
+	defer s.removeStream(session, 0)
+
+	common.CopyLoop(snowflakeConn, destinationConn, s.ctx.Done())
+	log.Printf(
+		"Connection ended %v",
+		destinationConn.RemoteAddr().String(),
+	)
+}
+
+func (s *Server) dialDestination(clientKey string) (net.Conn, error) {
+	if s.config.Balancer != nil {
+		return s.config.Balancer.Dial(s.ctx, clientKey)
+	}
+	return s.config.Dialer.DialContext(
+		s.ctx,
+		s.config.DestinationProtocol,
+		s.config.DestinationAddress,
+	)
+}
+
+// Reads the destination header of the stream (see `common.FeatureDestinations`),
+// connects to the destination and responds to the client.
+// The returned `clientConn` must be closed even if `err` is not `nil`.
+func (s *Server) dialRequestedDestination(
+	stream *smux.Stream,
+) (clientConn net.Conn, destinationConn net.Conn, err error) {
+	stream.SetReadDeadline(time.Now().Add(common.HandshakeTimeout))
+	network, address, err := common.ReadDestinationRequest(stream)
+	stream.SetReadDeadline(time.Time{})
+	if err != nil {
+		return stream, nil, fmt.Errorf("failed to read the destination: %w", err)
+	}
+
+	resolvedAddress, err := s.config.DestinationACL.Resolve(s.ctx, network, address)
+	if err != nil {
+		if errors.Is(err, common.ErrDestinationForbidden) {
+			common.WriteDestinationResponse(stream, common.DestinationForbidden)
+		} else {
+			common.WriteDestinationResponse(stream, common.DestinationUnreachable)
+		}
+		return stream, nil, err
+	}
+	destinationConn, err = s.config.Dialer.DialContext(s.ctx, network, resolvedAddress)
+	if err != nil {
+		// `Dialer` might have its own `ACL`, see `NewACLDialer()`.
+		if errors.Is(err, common.ErrDestinationForbidden) {
+			common.WriteDestinationResponse(stream, common.DestinationForbidden)
+		} else {
+			common.WriteDestinationResponse(stream, common.DestinationUnreachable)
+		}
+		return stream, nil, err
+	}
+	if err := common.WriteDestinationResponse(stream, common.DestinationOK); err != nil {
+		destinationConn.Close()
+		return stream, nil, err
+	}
+	if network == "udp" {
+		return common.NewDatagramConn(stream), destinationConn, nil
+	}
+	return stream, destinationConn, nil
+}
+
+// Close stops all `Serve()` calls, closing their listeners,
+// and closes all Snowflake client connections.
+func (s *Server) Close() error {
+	s.cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for ln := range s.listeners {
+		if lnErr := ln.Close(); lnErr != nil && err == nil {
+			err = lnErr
+		}
+	}
+	for _, entry := range s.bonds {
+		// Otherwise they would wait for new paths.
+		go entry.bond.Close()
+	}
+	return err
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/WofWca/snowflake-generalized/common"
+	"github.com/xtaci/smux"
+)
+
+const testDestination = "destination:7"
+
+// Serves `handle` for the connections to `address` on `dialer`.
+func serveMemory(t *testing.T, dialer *MemoryDialer, network, address string, handle func(net.Conn)) {
+	t.Helper()
+	ln, err := dialer.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+}
+
+// Echoes every `Read()` with a single `Write()`,
+// so it echoes datagrams as well.
+func echo(conn net.Conn) {
+	buf := make([]byte, common.MaxDatagramSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+// Starts a server whose destination is an echo server,
+// and returns a function that connects a Snowflake client to it.
+func newTestServer(t *testing.T, config Config) func() net.Conn {
+	t.Helper()
+	dialer := NewMemoryDialer()
+	serveMemory(t, dialer, config.DestinationProtocol, testDestination, echo)
+	config.Dialer = dialer
+	config.DestinationAddress = testDestination
+	server := NewServer(config)
+	t.Cleanup(func() { server.Close() })
+	return connectToServer(t, server)
+}
+
+// Returns a function that connects a Snowflake client to `server`.
+func connectToServer(t *testing.T, server *Server) func() net.Conn {
+	return func() net.Conn {
+		clientEnd, serverEnd := net.Pipe()
+		go server.ServeConn(serverEnd)
+		t.Cleanup(func() { clientEnd.Close() })
+		return clientEnd
+	}
+}
+
+func newTestMuxSession(t *testing.T, conn net.Conn, version int) *smux.Session {
+	t.Helper()
+	smuxConfig := smux.DefaultConfig()
+	smuxConfig.Version = version
+	smuxConfig.KeepAliveDisabled = true
+	session, err := smux.Client(conn, smuxConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.Close() })
+	return session
+}
+
+func checkEcho(t *testing.T, conn net.Conn, message []byte) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write(message); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply, message) {
+		t.Fatalf("got %q, want %q", reply, message)
+	}
+}
+
+func checkMuxEcho(t *testing.T, session *smux.Session) {
+	t.Helper()
+	stream, err := session.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	checkEcho(t, stream, []byte("hello"))
+}
+
+func TestHandshakeNegotiation(t *testing.T) {
+	connect := newTestServer(t, Config{DestinationProtocol: "tcp"})
+	for _, test := range []struct {
+		name         string
+		smuxVersions []int
+		want         int
+	}{
+		{"prefers v2", []int{2, 1}, 2},
+		{"client prefers v1", []int{1, 2}, 1},
+		{"only v1", []int{1}, 1},
+		{"only v2", []int{2}, 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conn := connect()
+			hello := common.NewHello()
+			hello.SmuxVersions = test.smuxVersions
+			result, err := common.ClientHandshake(conn, hello)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.SmuxVersion != test.want {
+				t.Fatalf("negotiated smux v%v, want v%v", result.SmuxVersion, test.want)
+			}
+			// Not offered for TCP.
+			if result.HasFeature(common.FeatureDatagramFraming) {
+				t.Errorf("negotiated %v", common.FeatureDatagramFraming)
+			}
+			checkMuxEcho(t, newTestMuxSession(t, conn, result.SmuxVersion))
+		})
+	}
+
+	t.Run("no common version", func(t *testing.T) {
+		hello := common.NewHello()
+		hello.SmuxVersions = []int{3}
+		if _, err := common.ClientHandshake(connect(), hello); err != common.ErrNoCommonSmuxVersion {
+			t.Fatalf("got %v, want %v", err, common.ErrNoCommonSmuxVersion)
+		}
+	})
+}
+
+func TestLegacyClient(t *testing.T) {
+	connect := newTestServer(t, Config{DestinationProtocol: "tcp"})
+	for _, version := range []int{1, 2} {
+		t.Run(fmt.Sprintf("smux v%v", version), func(t *testing.T) {
+			checkMuxEcho(t, newTestMuxSession(t, connect(), version))
+		})
+	}
+}
+
+func TestSingleConnMode(t *testing.T) {
+	t.Run("new client", func(t *testing.T) {
+		connect := newTestServer(t, Config{DestinationProtocol: "tcp", SingleConnMode: true})
+		conn := connect()
+		if _, err := common.ClientHandshake(conn, common.NewHello()); err != nil {
+			t.Fatal(err)
+		}
+		checkEcho(t, conn, []byte("hello"))
+	})
+
+	t.Run("legacy client", func(t *testing.T) {
+		connect := newTestServer(t, Config{DestinationProtocol: "tcp", SingleConnMode: true})
+		checkEcho(t, connect(), []byte("hello"))
+	})
+
+	// E.g. SSH, where the client waits for the server's banner.
+	t.Run("legacy client, destination speaks first", func(t *testing.T) {
+		dialer := NewMemoryDialer()
+		banner := []byte("SSH-2.0-test\r\n")
+		serveMemory(t, dialer, "tcp", testDestination, func(conn net.Conn) {
+			conn.Write(banner)
+			io.Copy(io.Discard, conn)
+		})
+		server := NewServer(Config{
+			DestinationProtocol: "tcp",
+			DestinationAddress:  testDestination,
+			Dialer:              dialer,
+			SingleConnMode:      true,
+		})
+		defer server.Close()
+		clientEnd, serverEnd := net.Pipe()
+		defer clientEnd.Close()
+		go server.ServeConn(serverEnd)
+
+		clientEnd.SetReadDeadline(time.Now().Add(common.SingleConnFirstByteTimeout + 5*time.Second))
+		got := make([]byte, len(banner))
+		if _, err := io.ReadFull(clientEnd, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, banner) {
+			t.Fatalf("got %q, want %q", got, banner)
+		}
+	})
+}
+
+// Datagrams bigger than `common.CopyLoop`'s buffer must arrive whole
+// in both directions.
+func TestDatagrams(t *testing.T) {
+	connect := newTestServer(t, Config{DestinationProtocol: "udp"})
+	conn := connect()
+	result, err := common.ClientHandshake(conn, common.NewHello())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.HasFeature(common.FeatureDatagramFraming) {
+		t.Fatalf("%v not negotiated", common.FeatureDatagramFraming)
+	}
+	stream, err := newTestMuxSession(t, conn, result.SmuxVersion).OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	datagramConn := common.NewDatagramConn(stream)
+	defer datagramConn.Close()
+
+	buf := make([]byte, common.MaxDatagramSize)
+	for _, size := range []int{1, 1400, 5000, common.MaxDatagramSize} {
+		datagram := bytes.Repeat([]byte{byte(size)}, size)
+		if _, err := datagramConn.Write(datagram); err != nil {
+			t.Fatal(err)
+		}
+		datagramConn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		n, err := datagramConn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], datagram) {
+			t.Fatalf("sent %v bytes, got %v back", size, n)
+		}
+	}
+}
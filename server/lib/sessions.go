@@ -0,0 +1,281 @@
+package server
+
+import (
+	"cmp"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSessionNotFound is returned by `CloseSession()` and `CloseStream()`
+// if there is no such session.
+var ErrSessionNotFound = errors.New("no such session")
+
+// ErrStreamNotFound is returned by `CloseStream()`
+// if the session has no such stream.
+var ErrStreamNotFound = errors.New("no such stream")
+
+// SessionInfo describes a Snowflake client connection
+// that is being served, see `Server.Sessions()`.
+// "From" and "to" are from the point of view of the client.
+type SessionInfo struct {
+	ID uint64 `json:"id"`
+	// RemoteAddress is the remote address of the Snowflake connection.
+	RemoteAddress string `json:"remoteAddress"`
+	// Client identifies the Snowflake client, see `common.Hello.ClientID`.
+	Client string `json:"client"`
+	// User is the name of the `User` that the client has authenticated as.
+	User            string       `json:"user,omitempty"`
+	Started         time.Time    `json:"started"`
+	BytesFromClient int64        `json:"bytesFromClient"`
+	BytesToClient   int64        `json:"bytesToClient"`
+	Streams         []StreamInfo `json:"streams"`
+}
+
+// StreamInfo describes a connection of a client to a destination.
+// In single-connection mode, the session has one stream, with ID 0.
+type StreamInfo struct {
+	ID              uint32    `json:"id"`
+	Destination     string    `json:"destination"`
+	Started         time.Time `json:"started"`
+	BytesFromClient int64     `json:"bytesFromClient"`
+	BytesToClient   int64     `json:"bytesToClient"`
+}
+
+type sessionEntry struct {
+	id            uint64
+	remoteAddress string
+	client        string
+	user          string
+	started       time.Time
+	counter       byteCounter
+	close         func()
+	// Protected by `Server.mu`.
+	streams map[uint32]*streamEntry
+}
+
+type streamEntry struct {
+	destination string
+	started     time.Time
+	counter     byteCounter
+	close       func()
+}
+
+type byteCounter struct {
+	fromClient atomic.Int64
+	toClient   atomic.Int64
+}
+
+// Counts the bytes that go through the connection to the client.
+type countingConn struct {
+	net.Conn
+	counter *byteCounter
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.counter.fromClient.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.counter.toClient.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) WriteTo(w io.Writer) (int64, error) {
+	return countedWriteTo(c.Conn, w, func(n int) error {
+		c.counter.fromClient.Add(int64(n))
+		return nil
+	})
+}
+
+func (c *countingConn) ReadFrom(r io.Reader) (int64, error) {
+	return countedReadFrom(c.Conn, r, func(n int) error {
+		c.counter.toClient.Add(int64(n))
+		return nil
+	})
+}
+
+// A wrapper of a connection must not hide its `io.WriterTo`
+// and `io.ReaderFrom`, because for `common.DatagramConn` they are
+// what keeps `common.CopyLoop` from truncating datagrams
+// to the size of its buffer.
+// These forward them, calling `count` for every `Write()`
+// (or `Read()`), which they pass through as is.
+
+func countedWriteTo(conn net.Conn, w io.Writer, count func(n int) error) (int64, error) {
+	cw := &countingWriter{Writer: w, count: count}
+	if writerTo, ok := conn.(io.WriterTo); ok {
+		return writerTo.WriteTo(cw)
+	}
+	return io.Copy(cw, struct{ io.Reader }{conn})
+}
+
+func countedReadFrom(conn net.Conn, r io.Reader, count func(n int) error) (int64, error) {
+	cr := &countingReader{Reader: r, count: count}
+	if readerFrom, ok := conn.(io.ReaderFrom); ok {
+		return readerFrom.ReadFrom(cr)
+	}
+	return io.Copy(struct{ io.Writer }{conn}, cr)
+}
+
+type countingWriter struct {
+	io.Writer
+	count func(n int) error
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	if countErr := w.count(n); countErr != nil && err == nil {
+		err = countErr
+	}
+	return n, err
+}
+
+type countingReader struct {
+	io.Reader
+	count func(n int) error
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if countErr := r.count(n); countErr != nil && err == nil {
+		err = countErr
+	}
+	return n, err
+}
+
+// Registers the Snowflake client connection `conn`, so that it's listed
+// by `Sessions()`, and returns `conn` wrapped to count its traffic.
+// Call `removeSession()` when it's closed.
+func (s *Server) addSession(
+	remoteAddr net.Addr,
+	conn net.Conn,
+	clientKey string,
+	user *User,
+) (*sessionEntry, net.Conn) {
+	session := &sessionEntry{
+		id:            s.nextSessionID.Add(1),
+		remoteAddress: remoteAddr.String(),
+		client:        clientKey,
+		started:       time.Now(),
+		close:         func() { conn.Close() },
+		streams:       make(map[uint32]*streamEntry),
+	}
+	if user != nil {
+		session.user = user.Name
+	}
+	s.mu.Lock()
+	s.sessions[session.id] = session
+	s.mu.Unlock()
+	return session, &countingConn{Conn: conn, counter: &session.counter}
+}
+
+func (s *Server) removeSession(session *sessionEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, session.id)
+}
+
+// Registers the connection of the client to the destination,
+// and returns `clientConn` wrapped to count its traffic.
+// Call `removeStream()` when it's closed.
+func (s *Server) addStream(
+	session *sessionEntry,
+	id uint32,
+	clientConn net.Conn,
+	destinationConn net.Conn,
+) net.Conn {
+	stream := &streamEntry{
+		destination: destinationConn.RemoteAddr().String(),
+		started:     time.Now(),
+		close: func() {
+			clientConn.Close()
+			destinationConn.Close()
+		},
+	}
+	s.mu.Lock()
+	session.streams[id] = stream
+	s.mu.Unlock()
+	return &countingConn{Conn: clientConn, counter: &stream.counter}
+}
+
+func (s *Server) removeStream(session *sessionEntry, id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(session.streams, id)
+}
+
+// Sessions returns the Snowflake client connections
+// that are being served, sorted by ID.
+func (s *Server) Sessions() []SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]SessionInfo, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		info := SessionInfo{
+			ID:              session.id,
+			RemoteAddress:   session.remoteAddress,
+			Client:          session.client,
+			User:            session.user,
+			Started:         session.started,
+			BytesFromClient: session.counter.fromClient.Load(),
+			BytesToClient:   session.counter.toClient.Load(),
+			Streams:         make([]StreamInfo, 0, len(session.streams)),
+		}
+		for id, stream := range session.streams {
+			info.Streams = append(info.Streams, StreamInfo{
+				ID:              id,
+				Destination:     stream.destination,
+				Started:         stream.started,
+				BytesFromClient: stream.counter.fromClient.Load(),
+				BytesToClient:   stream.counter.toClient.Load(),
+			})
+		}
+		slices.SortFunc(info.Streams, func(a, b StreamInfo) int { return cmp.Compare(a.ID, b.ID) })
+		list = append(list, info)
+	}
+	slices.SortFunc(list, func(a, b SessionInfo) int { return cmp.Compare(a.ID, b.ID) })
+	return list
+}
+
+// CloseSession closes the Snowflake client connection with the ID,
+// along with all its streams.
+// The client may reconnect, unless it's rejected otherwise,
+// e.g. by removing its `User`.
+func (s *Server) CloseSession(id uint64) error {
+	s.mu.Lock()
+	session, ok := s.sessions[id]
+	s.mu.Unlock()
+	if !ok {
+		return ErrSessionNotFound
+	}
+	log.Printf("Closing session %v", id)
+	session.close()
+	return nil
+}
+
+// CloseStream closes the stream of the session,
+// leaving the rest of the session intact.
+func (s *Server) CloseStream(sessionID uint64, streamID uint32) error {
+	s.mu.Lock()
+	session, ok := s.sessions[sessionID]
+	if !ok {
+		s.mu.Unlock()
+		return ErrSessionNotFound
+	}
+	stream, ok := session.streams[streamID]
+	s.mu.Unlock()
+	if !ok {
+		return ErrStreamNotFound
+	}
+	log.Printf("Closing stream %v of session %v", streamID, sessionID)
+	stream.close()
+	return nil
+}
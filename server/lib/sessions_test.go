@@ -0,0 +1,55 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/WofWca/snowflake-generalized/common"
+)
+
+// `common.CopyLoop` copies with a 2 KB buffer, which must not truncate
+// datagrams that go through a `countingConn`.
+func TestCountingConnDatagrams(t *testing.T) {
+	clientEnd, serverEnd := net.Pipe()
+	client := common.NewDatagramConn(clientEnd)
+	defer client.Close()
+	var counter byteCounter
+	counted := &countingConn{Conn: common.NewDatagramConn(serverEnd), counter: &counter}
+	defer counted.Close()
+
+	destinationEnd, peerEnd := net.Pipe()
+	destination := common.NewDatagramConn(destinationEnd)
+	defer destination.Close()
+	peer := common.NewDatagramConn(peerEnd)
+	defer peer.Close()
+	go common.CopyLoop(counted, destination, nil)
+
+	datagram := bytes.Repeat([]byte{'x'}, 5000)
+	buf := make([]byte, common.MaxDatagramSize)
+
+	client.Write(datagram)
+	n, err := peer.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(datagram) {
+		t.Fatalf("the datagram from the client is %v bytes, want %v", n, len(datagram))
+	}
+
+	peer.Write(datagram)
+	n, err = client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(datagram) {
+		t.Fatalf("the datagram to the client is %v bytes, want %v", n, len(datagram))
+	}
+
+	if got := counter.fromClient.Load(); got != int64(len(datagram)) {
+		t.Errorf("counted %v bytes from the client, want %v", got, len(datagram))
+	}
+	if got := counter.toClient.Load(); got != int64(len(datagram)) {
+		t.Errorf("counted %v bytes to the client, want %v", got, len(datagram))
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// Performs UDP ASSOCIATE (RFC 1928, section 7) and returns a connection
+// that sends and receives datagrams to / from `address`
+// through the proxy's UDP relay.
+// One `Write()` is one datagram, and so is one `Read()`.
+//
+// The association lasts as long as the TCP control connection,
+// so the returned connection gets closed when the proxy closes it.
+func (d *socks5Dialer) dialUDP(ctx context.Context, address string) (net.Conn, error) {
+	controlConn, err := d.forward.DialContext(ctx, "tcp", d.proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the SOCKS5 proxy: %w", err)
+	}
+	stop := bindConnToContext(ctx, controlConn)
+	defer stop()
+
+	if err := d.negotiate(controlConn); err != nil {
+		controlConn.Close()
+		return nil, err
+	}
+	// We don't know our address as seen by the proxy, so let's send zeros.
+	relayAddr, err := d.request(controlConn, socks5CmdUDPAssociate, "0.0.0.0:0")
+	if err != nil {
+		controlConn.Close()
+		return nil, err
+	}
+	relayHost, relayPort, err := net.SplitHostPort(relayAddr)
+	if err != nil {
+		controlConn.Close()
+		return nil, err
+	}
+	if ip := net.ParseIP(relayHost); ip != nil && ip.IsUnspecified() {
+		// "0.0.0.0" means "the same address as the proxy's".
+		proxyHost, _, _ := net.SplitHostPort(d.proxyAddr)
+		relayAddr = net.JoinHostPort(proxyHost, relayPort)
+	}
+
+	header, err := appendSocks5Addr([]byte{0, 0, 0}, address)
+	if err != nil {
+		controlConn.Close()
+		return nil, err
+	}
+	udpConn, err := d.forward.DialContext(ctx, "udp", relayAddr)
+	if err != nil {
+		controlConn.Close()
+		return nil, fmt.Errorf("failed to connect to the SOCKS5 UDP relay: %w", err)
+	}
+
+	conn := &socks5UDPConn{
+		Conn:        udpConn,
+		controlConn: controlConn,
+		header:      header,
+		destination: address,
+		// Max UDP payload size.
+		buf: make([]byte, 65535),
+	}
+	go conn.watchControlConn()
+	return conn, nil
+}
+
+type socks5UDPConn struct {
+	// The UDP socket connected to the proxy's relay.
+	net.Conn
+	controlConn net.Conn
+	// RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT
+	header []byte
+	// What `dialUDP()` was called with.
+	destination string
+	// For `Read()`.
+	buf []byte
+
+	closeOnce sync.Once
+}
+
+func (c *socks5UDPConn) watchControlConn() {
+	// The proxy is not supposed to send anything on the control connection.
+	io.Copy(io.Discard, c.controlConn)
+	c.Close()
+}
+
+func (c *socks5UDPConn) Write(b []byte) (int, error) {
+	datagram := make([]byte, 0, len(c.header)+len(b))
+	datagram = append(datagram, c.header...)
+	datagram = append(datagram, b...)
+	if _, err := c.Conn.Write(datagram); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+var errSocks5Fragmented = errors.New("fragmented SOCKS5 UDP datagrams are not supported")
+
+// Must not be called concurrently, which `io.Copy` doesn't do.
+func (c *socks5UDPConn) Read(b []byte) (int, error) {
+	for {
+		n, fromRelay, err := c.readFromRelay()
+		if err != nil {
+			return 0, err
+		}
+		if !fromRelay {
+			// Anyone can send datagrams to our port.
+			continue
+		}
+		from, payload, err := parseSocks5UDPDatagram(c.buf[:n])
+		if err != nil {
+			// Just drop it, as the RFC suggests for fragments.
+			continue
+		}
+		if !sameSocks5Destination(from, c.destination) {
+			continue
+		}
+		return copy(b, payload), nil
+	}
+}
+
+// Reads a datagram into `c.buf` and tells whether it came
+// from the relay, if the connection can tell.
+func (c *socks5UDPConn) readFromRelay() (n int, fromRelay bool, err error) {
+	packetConn, ok := c.Conn.(net.PacketConn)
+	if !ok {
+		n, err = c.Conn.Read(c.buf)
+		return n, true, err
+	}
+	n, from, err := packetConn.ReadFrom(c.buf)
+	if err != nil {
+		return n, false, err
+	}
+	relay, relayOk := netipAddrPort(c.Conn.RemoteAddr())
+	source, sourceOk := netipAddrPort(from)
+	return n, relayOk && sourceOk && relay == source, nil
+}
+
+// Unmapped, so that "::ffff:1.2.3.4" equals "1.2.3.4".
+func netipAddrPort(addr net.Addr) (netip.AddrPort, bool) {
+	if addr == nil {
+		return netip.AddrPort{}, false
+	}
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()), true
+}
+
+// Tells whether the datagram that the relay says came from `from`
+// is from `destination`.
+// If `destination` is a hostname, we don't know what the proxy
+// has resolved it to, so only the port is checked.
+// Wrap the dialer with `NewACLDialer()`, which resolves the hostnames,
+// for the full check.
+func sameSocks5Destination(from string, destination string) bool {
+	fromHost, fromPort, err := net.SplitHostPort(from)
+	if err != nil {
+		return false
+	}
+	host, port, err := net.SplitHostPort(destination)
+	if err != nil || fromPort != port {
+		return false
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return true
+	}
+	fromIP, err := netip.ParseAddr(fromHost)
+	return err == nil && fromIP.Unmap() == ip.Unmap()
+}
+
+func parseSocks5UDPDatagram(datagram []byte) (from string, payload []byte, err error) {
+	if len(datagram) < 4 {
+		return "", nil, errors.New("SOCKS5 UDP datagram is too short")
+	}
+	if datagram[2] != 0 {
+		return "", nil, errSocks5Fragmented
+	}
+	r := bytes.NewReader(datagram[3:])
+	from, err = readSocks5Addr(r)
+	if err != nil {
+		return "", nil, err
+	}
+	return from, datagram[len(datagram)-r.Len():], nil
+}
+
+func (c *socks5UDPConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.Conn.Close()
+		c.controlConn.Close()
+	})
+	return err
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// A SOCKS5 proxy that only supports UDP ASSOCIATE without authentication,
+// and whose UDP relay is `relay`, which the test drives itself.
+func serveFakeSocks5UDPProxy(t *testing.T, relay net.PacketConn) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		greeting := make([]byte, 3)
+		if _, err := io.ReadFull(conn, greeting); err != nil {
+			return
+		}
+		conn.Write([]byte{socks5Version, socks5AuthNone})
+		if _, err := io.ReadFull(conn, make([]byte, 3)); err != nil {
+			return
+		}
+		if _, err := readSocks5Addr(conn); err != nil {
+			return
+		}
+		reply, _ := appendSocks5Addr([]byte{socks5Version, 0, 0}, relay.LocalAddr().String())
+		conn.Write(reply)
+		// The association lasts as long as this connection.
+		io.Copy(io.Discard, conn)
+	}()
+	return ln.Addr().String()
+}
+
+func TestSocks5UDPReadFilters(t *testing.T) {
+	relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	stranger, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+
+	proxyURL := &url.URL{Scheme: "socks5", Host: serveFakeSocks5UDPProxy(t, relay)}
+	dialer, err := NewProxyDialer(proxyURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const destination = "192.0.2.1:53"
+	conn, err := dialer.DialContext(context.Background(), "udp", destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// So that the relay learns our address.
+	if _, err := conn.Write([]byte("query")); err != nil {
+		t.Fatal(err)
+	}
+	relay.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 1024)
+	n, client, err := relay.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, payload, err := parseSocks5UDPDatagram(buf[:n]); err != nil || string(payload) != "query" {
+		t.Fatalf("the relay got %q, %v", buf[:n], err)
+	}
+
+	datagram := func(from string, payload string) []byte {
+		b, err := appendSocks5Addr([]byte{0, 0, 0}, from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(b, payload...)
+	}
+	stranger.WriteTo(datagram(destination, "not from the relay"), client)
+	relay.WriteTo(datagram("192.0.2.2:53", "another address"), client)
+	relay.WriteTo(datagram("192.0.2.1:54", "another port"), client)
+	fragment := datagram(destination, "fragment")
+	fragment[2] = 1
+	relay.WriteTo(fragment, client)
+	relay.WriteTo(datagram(destination, "answer"), client)
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	// The first one that it returns must be the only valid one.
+	n, err = conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "answer" {
+		t.Fatalf("got %q, want %q", buf[:n], "answer")
+	}
+}
+
+func TestSameSocks5Destination(t *testing.T) {
+	for _, test := range []struct {
+		from, destination string
+		want              bool
+	}{
+		{"192.0.2.1:53", "192.0.2.1:53", true},
+		{"192.0.2.1:53", "[::ffff:192.0.2.1]:53", true},
+		{"192.0.2.2:53", "192.0.2.1:53", false},
+		{"192.0.2.1:54", "192.0.2.1:53", false},
+		{"example.com:53", "192.0.2.1:53", false},
+		// We don't know what the proxy has resolved it to.
+		{"192.0.2.1:53", "example.com:53", true},
+		{"192.0.2.1:54", "example.com:53", false},
+	} {
+		if got := sameSocks5Destination(test.from, test.destination); got != test.want {
+			t.Errorf("sameSocks5Destination(%q, %q) = %v, want %v", test.from, test.destination, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// User is who the clients that present its `Token`
+// (see `common.Hello.Token`) act on behalf of, e.g. a team.
+// See `Config.Users`.
+type User struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	// DailyBytes limits how many bytes (in both directions)
+	// the user may transfer per day (UTC). 0 means no limit.
+	// Requires `Config.Accounting`.
+	DailyBytes int64 `json:"dailyBytes,omitempty"`
+	// MonthlyBytes is like `DailyBytes`, but per calendar month.
+	MonthlyBytes int64 `json:"monthlyBytes,omitempty"`
+	// MaxStreams limits how many connections the user's clients
+	// may have at the same time. 0 means no limit.
+	MaxStreams int `json:"maxStreams,omitempty"`
+}
+
+// ParseUsers parses a JSON array of `User`s, e.g.
+//
+//	[
+//		{"name": "team-a", "token": "<random string>", "monthlyBytes": 100000000000},
+//		{"name": "team-b", "token": "<random string>", "maxStreams": 100}
+//	]
+func ParseUsers(r io.Reader) ([]User, error) {
+	var users []User
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&users); err != nil {
+		return nil, err
+	}
+	names := make(map[string]struct{})
+	tokens := make(map[string]struct{})
+	for _, user := range users {
+		if user.Name == "" || user.Token == "" {
+			return nil, errors.New("every user must have a name and a token")
+		}
+		if _, ok := names[user.Name]; ok {
+			return nil, fmt.Errorf("duplicate user name %q", user.Name)
+		}
+		if _, ok := tokens[user.Token]; ok {
+			return nil, fmt.Errorf("user %q has the same token as another user", user.Name)
+		}
+		names[user.Name] = struct{}{}
+		tokens[user.Token] = struct{}{}
+	}
+	return users, nil
+}
+
+var errUnknownToken = errors.New("unknown token")
+
+// Tracks the users' streams and enforces their limits.
+type userLimiter struct {
+	// By the SHA-256 of `User.Token`, so that looking a token up
+	// doesn't take longer the more of it matches a real token.
+	users      map[[sha256.Size]byte]*User
+	accounting *Accounting
+
+	mu            sync.Mutex
+	activeStreams map[string]int
+}
+
+func newUserLimiter(users []User, accounting *Accounting) *userLimiter {
+	l := &userLimiter{
+		users:         make(map[[sha256.Size]byte]*User),
+		accounting:    accounting,
+		activeStreams: make(map[string]int),
+	}
+	for i := range users {
+		l.users[sha256.Sum256([]byte(users[i].Token))] = &users[i]
+	}
+	return l
+}
+
+// Returns the user with the token, if it may connect.
+func (l *userLimiter) authenticate(token string) (*User, error) {
+	user, ok := l.users[sha256.Sum256([]byte(token))]
+	if !ok {
+		return nil, errUnknownToken
+	}
+	if err := l.checkQuota(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (l *userLimiter) checkQuota(user *User) error {
+	if l.accounting == nil {
+		return nil
+	}
+	return user.checkQuota(l.accounting.Usage(user.Name))
+}
+
+func (user *User) checkQuota(usage Usage) error {
+	if user.DailyBytes > 0 && usage.DayBytes >= user.DailyBytes {
+		return fmt.Errorf("the daily quota of %v bytes is exceeded", user.DailyBytes)
+	}
+	if user.MonthlyBytes > 0 && usage.MonthBytes >= user.MonthlyBytes {
+		return fmt.Errorf("the monthly quota of %v bytes is exceeded", user.MonthlyBytes)
+	}
+	return nil
+}
+
+// Counts a new stream of `user`, if it doesn't exceed its limits.
+// Call `release` when the stream is closed.
+func (l *userLimiter) startStream(user *User) (release func(), err error) {
+	if err := l.checkQuota(user); err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if user.MaxStreams > 0 && l.activeStreams[user.Name] >= user.MaxStreams {
+		return nil, fmt.Errorf("the limit of %v connections is reached", user.MaxStreams)
+	}
+	l.activeStreams[user.Name]++
+	var releaseOnce sync.Once
+	return func() {
+		releaseOnce.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.activeStreams[user.Name]--
+		})
+	}, nil
+}
+
+// Wraps `conn` so that its traffic is accounted to `user`.
+func (l *userLimiter) meter(user *User, conn net.Conn) net.Conn {
+	if l.accounting == nil {
+		return conn
+	}
+	return &userConn{Conn: conn, user: user, accounting: l.accounting}
+}
+
+// Accounts the bytes that go through it,
+// and fails once the user's quota is exceeded.
+type userConn struct {
+	net.Conn
+	user       *User
+	accounting *Accounting
+}
+
+func (c *userConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if quotaErr := c.account(n); quotaErr != nil {
+		return n, quotaErr
+	}
+	return n, err
+}
+
+func (c *userConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if quotaErr := c.account(n); quotaErr != nil {
+		return n, quotaErr
+	}
+	return n, err
+}
+
+// See `countedWriteTo()`.
+func (c *userConn) WriteTo(w io.Writer) (int64, error) {
+	return countedWriteTo(c.Conn, w, c.account)
+}
+
+func (c *userConn) ReadFrom(r io.Reader) (int64, error) {
+	return countedReadFrom(c.Conn, r, c.account)
+}
+
+// Returns an error if the quota is exceeded.
+func (c *userConn) account(n int) error {
+	if n == 0 {
+		return nil
+	}
+	return c.user.checkQuota(c.accounting.Add(c.user.Name, int64(n)))
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/WofWca/snowflake-generalized/common"
+)
+
+func TestUserLimiterAuthenticate(t *testing.T) {
+	users := []User{{Name: "a", Token: "token-a"}, {Name: "b", Token: "token-b"}}
+	limiter := newUserLimiter(users, nil)
+	user, err := limiter.authenticate("token-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Name != "b" {
+		t.Errorf("authenticated as %q, want %q", user.Name, "b")
+	}
+	for _, token := range []string{"", "token-", "token-c", "token-a "} {
+		if _, err := limiter.authenticate(token); err != errUnknownToken {
+			t.Errorf("token %q: got %v, want %v", token, err, errUnknownToken)
+		}
+	}
+}
+
+// Like `TestCountingConnDatagrams`, and the quota still applies.
+func TestUserConnDatagrams(t *testing.T) {
+	accounting, err := NewAccounting(filepath.Join(t.TempDir(), "accounting.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accounting.Close()
+	users := []User{{Name: "a", Token: "token-a", DailyBytes: 8000}}
+	limiter := newUserLimiter(users, accounting)
+
+	clientEnd, serverEnd := net.Pipe()
+	client := common.NewDatagramConn(clientEnd)
+	defer client.Close()
+	metered := limiter.meter(&users[0], common.NewDatagramConn(serverEnd))
+	defer metered.Close()
+
+	destinationEnd, peerEnd := net.Pipe()
+	destination := common.NewDatagramConn(destinationEnd)
+	defer destination.Close()
+	peer := common.NewDatagramConn(peerEnd)
+	defer peer.Close()
+	done := make(chan struct{})
+	go func() {
+		common.CopyLoop(metered, destination, nil)
+		close(done)
+	}()
+
+	datagram := bytes.Repeat([]byte{'x'}, 5000)
+	buf := make([]byte, common.MaxDatagramSize)
+	client.Write(datagram)
+	n, err := peer.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(datagram) {
+		t.Fatalf("the datagram is %v bytes, want %v", n, len(datagram))
+	}
+
+	// This one exceeds the quota.
+	client.Write(datagram)
+	<-done
+	if usage := accounting.Usage("a"); usage.DayBytes != 2*int64(len(datagram)) {
+		t.Errorf("accounted %v bytes, want %v", usage.DayBytes, 2*len(datagram))
+	}
+}